@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	ACCESSACL  = "system.posix_acl_access"
+	DEFAULTACL = "system.posix_acl_default"
+)
+
+// Tags of POSIX ACL entries, as laid out by the kernel in the ACL
+// attributes.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+const aclVersion = 2
+
+// aclUndefinedID is the ID the kernel records in entries that name no
+// specific user or group.
+const aclUndefinedID = 0xffffffff
+
+// ACLPolicy decides what happens to the POSIX ACLs of files whose ownership
+// is taken.
+type ACLPolicy string
+
+const (
+	// ACLKeep leaves ACLs untouched.
+	ACLKeep ACLPolicy = ""
+	// ACLStrip removes the entries for named users.
+	ACLStrip ACLPolicy = "strip"
+	// ACLRewrite makes the entries for the previous owner name the new
+	// owner instead.
+	ACLRewrite ACLPolicy = "rewrite"
+	// ACLInherit replaces the ACLs with the default ACL of the directory
+	// containing the file, as if the file had just been created there.
+	ACLInherit ACLPolicy = "inherit"
+)
+
+func ParseACLPolicy(s string) (ACLPolicy, error) {
+	switch p := ACLPolicy(s); p {
+	case ACLKeep, ACLStrip, ACLRewrite, ACLInherit:
+		return p, nil
+	}
+	return ACLKeep, fmt.Errorf("invalid ACL policy %q (valid policies are %s, %s and %s)", s, string(ACLStrip), string(ACLRewrite), string(ACLInherit))
+}
+
+func (p ACLPolicy) String() string {
+	switch p {
+	case ACLStrip:
+		return "strip named user ACL entries"
+	case ACLRewrite:
+		return "rewrite ACL entries of previous owner"
+	case ACLInherit:
+		return "apply default ACL of parent directory"
+	}
+	return "keep ACLs"
+}
+
+type aclEntry struct {
+	Tag  uint16
+	Perm uint16
+	ID   uint32
+}
+
+type acl []aclEntry
+
+func parseACL(data []byte) (acl, error) {
+	if len(data) < 4 || (len(data)-4)%8 != 0 {
+		return nil, fmt.Errorf("malformed ACL of %d bytes", len(data))
+	}
+	if v := binary.LittleEndian.Uint32(data); v != aclVersion {
+		return nil, fmt.Errorf("unsupported ACL version %d", v)
+	}
+	a := acl{}
+	for n := 4; n < len(data); n += 8 {
+		a = append(a, aclEntry{
+			binary.LittleEndian.Uint16(data[n:]),
+			binary.LittleEndian.Uint16(data[n+2:]),
+			binary.LittleEndian.Uint32(data[n+4:]),
+		})
+	}
+	return a, nil
+}
+
+func (a acl) bytes() []byte {
+	data := make([]byte, 4+8*len(a))
+	binary.LittleEndian.PutUint32(data, aclVersion)
+	for n, e := range a {
+		binary.LittleEndian.PutUint16(data[4+8*n:], e.Tag)
+		binary.LittleEndian.PutUint16(data[4+8*n+2:], e.Perm)
+		binary.LittleEndian.PutUint32(data[4+8*n+4:], e.ID)
+	}
+	return data
+}
+
+// normalize sorts the entries in the order the kernel demands, removes
+// duplicate named entries, and drops the mask if no named entries remain,
+// folding it into the owning group entry so no permission is widened.
+func (a acl) normalize() acl {
+	sort.SliceStable(a, func(i, j int) bool {
+		if a[i].Tag != a[j].Tag {
+			return a[i].Tag < a[j].Tag
+		}
+		return a[i].ID < a[j].ID
+	})
+	result := acl{}
+	named := false
+	var mask *aclEntry
+	for n, e := range a {
+		if e.Tag == aclUser || e.Tag == aclGroup {
+			if n > 0 && a[n-1].Tag == e.Tag && a[n-1].ID == e.ID {
+				continue
+			}
+			named = true
+		}
+		if e.Tag == aclMask {
+			mask = &a[n]
+		}
+		result = append(result, e)
+	}
+	if named || mask == nil {
+		return result
+	}
+	final := acl{}
+	for _, e := range result {
+		switch e.Tag {
+		case aclMask:
+			continue
+		case aclGroupObj:
+			e.Perm = e.Perm & mask.Perm
+		}
+		final = append(final, e)
+	}
+	return final
+}
+
+// masq restricts the default ACL a to the permissions of mode, the way the
+// kernel does when a file is created in a directory with a default ACL.
+func (a acl) masq(mode FileMode) acl {
+	result := acl{}
+	hasMask := false
+	for _, e := range a {
+		if e.Tag == aclMask {
+			hasMask = true
+		}
+	}
+	for _, e := range a {
+		switch {
+		case e.Tag == aclUserObj:
+			e.Perm = e.Perm & uint16(mode>>6&7)
+		case e.Tag == aclMask, e.Tag == aclGroupObj && !hasMask:
+			e.Perm = e.Perm & uint16(mode>>3&7)
+		case e.Tag == aclOther:
+			e.Perm = e.Perm & uint16(mode&7)
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// aclChange records the ACL attributes of a file before and after applying
+// an ACL policy.  A nil attribute is an absent one.
+type aclChange struct {
+	path       string
+	oldAccess  *[]byte
+	newAccess  *[]byte
+	oldDefault *[]byte
+	newDefault *[]byte
+}
+
+func sameAttr(a *[]byte, b *[]byte) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return bytes.Equal(*a, *b)
+}
+
+func (c *aclChange) changed() bool {
+	return !sameAttr(c.oldAccess, c.newAccess) || !sameAttr(c.oldDefault, c.newDefault)
+}
+
+// apply writes the new ACLs to the file.
+func (c *aclChange) apply() error {
+	if !sameAttr(c.oldAccess, c.newAccess) {
+		if err := lsetxattr(c.path, ACCESSACL, c.newAccess); err != nil {
+			return err
+		}
+	}
+	if !sameAttr(c.oldDefault, c.newDefault) {
+		if err := lsetxattr(c.path, DEFAULTACL, c.newDefault); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revert restores the ACLs the file had before the change was applied.
+func (c *aclChange) revert() error {
+	if !sameAttr(c.oldAccess, c.newAccess) {
+		if err := lsetxattr(c.path, ACCESSACL, c.oldAccess); err != nil {
+			return err
+		}
+	}
+	if !sameAttr(c.oldDefault, c.newDefault) {
+		if err := lsetxattr(c.path, DEFAULTACL, c.oldDefault); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func attrOf(a acl) *[]byte {
+	b := a.bytes()
+	return &b
+}
+
+// Plan computes the ACL changes that taking ownership of the file, owned by
+// oldOwner, would entail for newOwner under this policy.  Symbolic links
+// have no ACLs, so callers must not pass them.
+func (p ACLPolicy) Plan(file string, stated sinfo, oldOwner UID, newOwner UID) (*aclChange, error) {
+	c := &aclChange{path: file}
+	if p == ACLKeep {
+		return c, nil
+	}
+	var err error
+	if c.oldAccess, err = lgetxattr(file, ACCESSACL); err != nil {
+		return nil, NewError("getfacl", file, err)
+	}
+	if stated.Dir {
+		if c.oldDefault, err = lgetxattr(file, DEFAULTACL); err != nil {
+			return nil, NewError("getfacl", file, err)
+		}
+	}
+	c.newAccess, c.newDefault = c.oldAccess, c.oldDefault
+
+	switch p {
+	case ACLStrip, ACLRewrite:
+		// The default ACL of a directory names users just like its access
+		// ACL does, and would hand them access to the files created in it.
+		if c.newAccess, err = p.rewrite(file, c.oldAccess, oldOwner, newOwner); err != nil {
+			return nil, err
+		}
+		if c.newDefault, err = p.rewrite(file, c.oldDefault, oldOwner, newOwner); err != nil {
+			return nil, err
+		}
+	case ACLInherit:
+		parent := filepath.Dir(file)
+		def, err := lgetxattr(parent, DEFAULTACL)
+		if err != nil {
+			return nil, NewError("getfacl", parent, err)
+		}
+		if def == nil {
+			// Files created in a directory without a default ACL have
+			// no ACL at all.
+			c.newAccess = nil
+			c.newDefault = nil
+			return c, nil
+		}
+		a, err := parseACL(*def)
+		if err != nil {
+			return nil, NewError("getfacl", parent, err)
+		}
+		c.newAccess = attrOf(a.masq(stated.Mode))
+		if stated.Dir {
+			c.newDefault = def
+		}
+	}
+	return c, nil
+}
+
+// rewrite strips the entries for named users from the ACL attribute, or
+// makes those for the previous owner name the new owner, according to the
+// policy.
+func (p ACLPolicy) rewrite(file string, attr *[]byte, oldOwner UID, newOwner UID) (*[]byte, error) {
+	if attr == nil {
+		return nil, nil
+	}
+	a, err := parseACL(*attr)
+	if err != nil {
+		return nil, NewError("getfacl", file, err)
+	}
+	b := acl{}
+	for _, e := range a {
+		if e.Tag == aclUser {
+			if p == ACLStrip {
+				continue
+			}
+			if UID(e.ID) == oldOwner {
+				e.ID = uint32(newOwner)
+			}
+		}
+		b = append(b, e)
+	}
+	return attrOf(b.normalize()), nil
+}
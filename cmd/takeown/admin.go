@@ -1,12 +1,56 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"runtime"
+	"strings"
 	"syscall"
 
 	"github.com/syndtr/gocapability/capability"
+	"golang.org/x/sys/unix"
 )
 
+// Installation is the way takeown gains the privileges it needs.
+type Installation int
+
+const (
+	// notPrivileged means takeown runs with no privileges at all, so it
+	// can only do what the calling user could do anyway.
+	notPrivileged Installation = iota
+	// runByAdmin means the administrator runs takeown.
+	runByAdmin
+	// installedSetuid means takeown is set-uid root.
+	installedSetuid
+	// installedCapabilities means takeown has the file capabilities in
+	// capabilitiesSpec, permitted but not effective until raised.
+	installedCapabilities
+)
+
+var installation Installation
+
+// capabilitiesSpec is how takeown is installed with file capabilities:
+// enough to change owners and modes, and to write security.* attributes.
+// Access to the files of users is still checked with the credentials of
+// the user, as the capabilities are lowered while it is.
+const capabilitiesSpec = "cap_chown,cap_fowner,cap_sys_admin+p"
+
+var neededCapabilities = []capability.Cap{capability.CAP_CHOWN, capability.CAP_FOWNER, capability.CAP_SYS_ADMIN}
+
+// stateGroup is the group takeown is set-gid to, as it is when installed
+// with file capabilities, or -1.  The state files, such as the lock and the
+// spool, and their directories then belong to root and to this group, which
+// lets takeown open them without being root.
+var stateGroup = -1
+
+func init() {
+	// Capabilities belong to threads, not processes.  Keeping main on the
+	// main thread ensures that the capabilities raised are those of the
+	// thread that does the work, and makes the runtime start new threads
+	// from a template thread that never had them effective.
+	runtime.LockOSThread()
+}
+
 func isAdmin() bool {
 	if os.Getuid() == 0 {
 		return true
@@ -14,44 +58,189 @@ func isAdmin() bool {
 	return false
 }
 
-func dropToCallingUser() {
-	if !isAdmin() {
-		uid := syscall.Getuid()
-		trace("dropping privileges to calling user %d", uid)
-		if err := syscall.Setuid(syscall.Getuid()); err != nil {
-			panic(err)
+// checkInstallation works out how takeown was installed, and refuses to run
+// if it holds more privileges than it should, or holds them the wrong way.
+// It must run before anything else.
+func checkInstallation() error {
+	uid, euid := os.Getuid(), os.Geteuid()
+	if egid := os.Getegid(); egid != os.Getgid() && egid != 0 {
+		stateGroup = egid
+	}
+	switch {
+	case uid == 0:
+		installation = runByAdmin
+		callerCanChown = hasEffectiveCapability(capability.CAP_CHOWN)
+		return nil
+	case euid == 0:
+		installation = installedSetuid
+		return nil
+	case euid != uid:
+		return fmt.Errorf("takeown is set-uid to UID %d instead of root", euid)
+	}
+
+	caps, err := capability.NewPid2(0)
+	if err == nil {
+		err = caps.Load()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read the capabilities of takeown: %v", err)
+	}
+	if caps.Empty(capability.PERMITTED) {
+		installation = notPrivileged
+		callerCanChown = caps.Get(capability.EFFECTIVE, capability.CAP_CHOWN)
+		return nil
+	}
+	extra := []string{}
+	for c := capability.Cap(0); c <= capability.CAP_LAST_CAP; c++ {
+		if caps.Get(capability.PERMITTED, c) && !isNeededCapability(c) {
+			extra = append(extra, "cap_"+c.String())
+		}
+	}
+	if len(extra) > 0 {
+		return fmt.Errorf("takeown has capabilities it does not need (%s); install it with %s", strings.Join(extra, ","), capabilitiesSpec)
+	}
+	missing := []string{}
+	for _, c := range neededCapabilities {
+		if !caps.Get(capability.PERMITTED, c) {
+			missing = append(missing, "cap_"+c.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("takeown lacks capabilities it needs (%s); install it with %s", strings.Join(missing, ","), capabilitiesSpec)
+	}
+	if !caps.Empty(capability.EFFECTIVE) {
+		return fmt.Errorf("takeown must not start with its capabilities effective; install it with %s", capabilitiesSpec)
+	}
+	if !caps.Empty(capability.INHERITABLE) || !caps.Empty(capability.AMBIENT) {
+		return fmt.Errorf("takeown must not run with inheritable or ambient capabilities")
+	}
+	if os.Getegid() == 0 {
+		return fmt.Errorf("takeown must not be set-gid to root")
+	}
+	if stateGroup < 0 {
+		return fmt.Errorf("takeown must be set-gid to the group of its state directories to run with capabilities")
+	}
+
+	installation = installedCapabilities
+	trace("running with file capabilities")
+	return setCapabilities(capability.EFFECTIVE, true)
+}
+
+func hasEffectiveCapability(c capability.Cap) bool {
+	caps, err := capability.NewPid2(0)
+	if err == nil {
+		err = caps.Load()
+	}
+	return err == nil && caps.Get(capability.EFFECTIVE, c)
+}
+
+func isNeededCapability(c capability.Cap) bool {
+	for _, n := range neededCapabilities {
+		if c == n {
+			return true
 		}
 	}
+	return false
+}
+
+// setCapabilities raises or lowers the needed capabilities in the sets of
+// the current thread.
+func setCapabilities(which capability.CapType, raise bool) error {
+	caps, err := capability.NewPid2(0)
+	if err == nil {
+		err = caps.Load()
+	}
+	if err != nil {
+		return err
+	}
+	if raise {
+		caps.Set(which, neededCapabilities...)
+	} else {
+		caps.Unset(which, neededCapabilities...)
+	}
+	return caps.Apply(capability.CAPS)
 }
 
-func dropToCallingUserTemporarily() {
-	if !isAdmin() {
+// dropToCallingUser gives up the privileges of takeown for good, so that
+// everything done afterwards is done as the calling user.
+func dropToCallingUser() error {
+	switch installation {
+	case installedSetuid:
 		uid := syscall.Getuid()
 		trace("dropping privileges to calling user %d", uid)
-		if err := syscall.Seteuid(syscall.Getuid()); err != nil {
-			panic(err)
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("cannot drop privileges to calling user %d: %v", uid, err)
+		}
+	case installedCapabilities:
+		trace("dropping capabilities")
+		if err := setCapabilities(capability.EFFECTIVE|capability.PERMITTED, false); err != nil {
+			return fmt.Errorf("cannot drop capabilities: %v", err)
+		}
+		gid := syscall.Getgid()
+		trace("dropping group %d for calling group %d", stateGroup, gid)
+		if err := syscall.Setresgid(gid, gid, gid); err != nil {
+			return fmt.Errorf("cannot drop group %d: %v", stateGroup, err)
 		}
 	}
+	return nil
 }
 
-func returnToRoot() {
-	if !isAdmin() {
-		trace("returning to root")
-		if err := syscall.Seteuid(0); err != nil {
-			panic(err)
+// asCallingUser runs fn with the filesystem credentials of the calling user,
+// so the kernel checks access to files for fn as it would for the user.
+// The filesystem UID and GID of the current thread are set to those of the
+// user; its supplementary groups already are the user's, since exec keeps
+// them and takeown never changes them.  The thread stays locked to the
+// goroutine while fn runs, and other threads keep their credentials.  If
+// the credentials of takeown cannot be put back afterwards, the error says
+// so, and the thread is left with no more than the credentials of the user.
+func asCallingUser(fn func() error) (err error) {
+	if installation == runByAdmin || installation == notPrivileged {
+		return fn()
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if installation == installedCapabilities {
+		if err := setCapabilities(capability.EFFECTIVE, false); err != nil {
+			return err
 		}
+		defer func() {
+			if e := setCapabilities(capability.EFFECTIVE, true); e != nil && err == nil {
+				err = fmt.Errorf("cannot raise capabilities again: %v", e)
+			}
+		}()
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	trace("switching to filesystem credentials of calling user %d:%d", uid, gid)
+	prevUid, prevGid, err := setfsids(uid, gid)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		trace("switching back to filesystem credentials %d:%d", prevUid, prevGid)
+		if _, _, e := setfsids(prevUid, prevGid); e != nil && err == nil {
+			err = e
+		}
+	}()
+	return fn()
 }
 
-func canAdminChownFile(file string) bool {
-	dropToCallingUserTemporarily()
-	defer returnToRoot()
-
-	cap := false
-	if caps, err := capability.NewPid2(os.Getpid()); err == nil {
-		if caps.Load() == nil {
-			cap = caps.Get(capability.EFFECTIVE, capability.CAP_CHOWN)
-		}
+// setfsids sets the filesystem UID and GID of the current thread, and
+// returns the previous ones.  The kernel does not report failures to set
+// them, so they are read back to check.
+func setfsids(uid int, gid int) (int, int, error) {
+	prevGid, _ := unix.SetfsgidRetGid(gid)
+	prevUid, _ := unix.SetfsuidRetUid(uid)
+	nowUid, _ := unix.SetfsuidRetUid(-1)
+	nowGid, _ := unix.SetfsgidRetGid(-1)
+	if nowUid != uid || nowGid != gid {
+		unix.SetfsuidRetUid(prevUid)
+		unix.SetfsgidRetGid(prevGid)
+		return prevUid, prevGid, fmt.Errorf("cannot switch to filesystem credentials %d:%d", uid, gid)
 	}
-	return cap
+	return prevUid, prevGid, nil
 }
+
+// callerCanChown is set if the calling user could change the owner of files
+// without takeown, as the administrator usually can.
+var callerCanChown bool
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// AUDITFILE receives audit events as JSON lines, in addition to syslog,
+// if it exists.
+var AUDITFILE = statePath("/var/log/takeown/audit.jsonl")
+
+// Actions recorded in audit events.
+const (
+	auditTake        = "take"
+	auditGive        = "give"
+	auditRelease     = "release"
+	auditAddGrant    = "add-grant"
+	auditDeleteGrant = "delete-grant"
+	auditRequest     = "request-grant"
+	auditReject      = "reject-request"
+	auditConsume     = "consume-grant"
+)
+
+// AuditEvent records an ownership change, or a change to the grants on a
+// path, along with its result.
+type AuditEvent struct {
+	Time   string `json:"time"`
+	Action string `json:"action"`
+	Caller UID    `json:"caller"`
+	Path   string `json:"path"`
+	Inode  uint64 `json:"inode,omitempty"`
+	// OldOwner and NewOwner are set for ownership changes.
+	OldOwner *UID `json:"old_owner,omitempty"`
+	NewOwner *UID `json:"new_owner,omitempty"`
+	// Delegation is the delegation that authorized an ownership change,
+	// or the grant added or removed.  Admin is set instead when the
+	// caller needed no delegation.
+	Delegation *auditDelegation `json:"delegation,omitempty"`
+	Admin      bool             `json:"admin,omitempty"`
+	// Request is the ID of the request for a delegation the event is
+	// about, if any.
+	Request uint64 `json:"request,omitempty"`
+	// Result is "success", or the error that prevented the change.
+	Result string `json:"result"`
+}
+
+// auditDelegation spells the grant out in full, even when plain.
+type auditDelegation struct {
+	Path  string      `json:"path"`
+	File  bool        `json:"file,omitempty"`
+	Grant grantRecord `json:"grant"`
+}
+
+func newAuditDelegation(d *Delegation) *auditDelegation {
+	if d == nil {
+		return nil
+	}
+	return &auditDelegation{d.Path, d.File, grantRecord(d.Grant)}
+}
+
+var auditSyslog *syslog.Writer
+var auditFile *os.File
+
+// openAuditLog connects to syslog and opens the audit file, if it exists.
+// It must run before privileges are dropped.  Not being able to reach
+// syslog is not an error, but an audit file that anyone but the
+// administrator could modify is.
+func openAuditLog() error {
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "takeown")
+	if err != nil {
+		trace("cannot connect to syslog: %v", err)
+	} else {
+		auditSyslog = w
+	}
+	f, err := os.OpenFile(AUDITFILE, os.O_WRONLY|os.O_APPEND|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := checkStateFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	auditFile = f
+	return nil
+}
+
+func auditResult(err error) string {
+	if err == nil {
+		return "success"
+	}
+	return err.Error()
+}
+
+// audit records the event to syslog and to the audit file.  Paths are made
+// absolute, and the time and caller are filled in.
+func audit(e AuditEvent) {
+	if auditSyslog == nil && auditFile == nil {
+		return
+	}
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	e.Caller = UID(os.Getuid())
+	if abs, err := filepath.Abs(e.Path); err == nil {
+		e.Path = abs
+	}
+	if e.Delegation != nil {
+		if abs, err := filepath.Abs(e.Delegation.Path); err == nil {
+			e.Delegation.Path = abs
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		trace("cannot marshal audit event: %v", err)
+		return
+	}
+	if auditSyslog != nil {
+		if err := auditSyslog.Notice(string(data)); err != nil {
+			trace("cannot log audit event to syslog: %v", err)
+		}
+	}
+	if auditFile != nil {
+		// A single write, so lines from concurrent runs do not mix.
+		if _, err := auditFile.Write(append(data, '\n')); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing to audit log %s: %v\n", AUDITFILE, err)
+		}
+	}
+}
+
+// auditChange records a change of ownership of the file, whose state
+// before the change is stated, authorized by the delegation, or by the
+// privileges of the caller if admin is set.
+func auditChange(v verb, file string, stated sinfo, to UID, d *Delegation, admin bool, err error) {
+	e := AuditEvent{
+		Path:       file,
+		NewOwner:   &to,
+		Delegation: newAuditDelegation(d),
+		Admin:      admin,
+		Result:     auditResult(err),
+	}
+	switch v {
+	case taking:
+		e.Action = auditTake
+	case giving:
+		e.Action = auditGive
+	case releasing:
+		e.Action = auditRelease
+	}
+	if stated.Ino != 0 {
+		owner := UID(stated.Uid)
+		e.Inode = stated.Ino
+		e.OldOwner = &owner
+	}
+	audit(e)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// option describes a command line option of a subcommand, for its help.
+type option struct {
+	short string
+	long  string
+	arg   string
+	help  string
+}
+
+// command is a subcommand of takeown, such as take or grant.
+type command struct {
+	name     string
+	synopsis string
+	// brief describes the command in the list of commands, and summary
+	// in its own help.
+	brief   string
+	summary string
+	// minArgs is the number of arguments the command requires, unless
+	// paths are read with --files-from, which may stand in for all
+	// arguments but the first.
+	minArgs int
+	run     func(o *options, args []string, listed []string) int
+
+	flags   *flag.FlagSet
+	options []option
+	o       options
+}
+
+func (c *command) boolOpt(p *bool, short string, long string, help string) {
+	if short != "" {
+		c.flags.BoolVar(p, short, false, help)
+	}
+	c.flags.BoolVar(p, long, false, help)
+	c.options = append(c.options, option{short, long, "", help})
+}
+
+func (c *command) stringOpt(p *string, short string, long string, arg string, help string) {
+	if short != "" {
+		c.flags.StringVar(p, short, "", help)
+	}
+	c.flags.StringVar(p, long, "", help)
+	c.options = append(c.options, option{short, long, arg, help})
+}
+
+func (c *command) listOpt(p flag.Value, long string, arg string, help string) {
+	c.flags.Var(p, long, help)
+	c.options = append(c.options, option{"", long, arg, help})
+}
+
+// help prints the synopsis, summary and options of the command.
+func (c *command) help(w io.Writer) {
+	fmt.Fprintf(w, "Usage: takeown %s %s\n\n%s\n\nOptions:\n", c.name, c.synopsis, c.summary)
+	for _, opt := range c.options {
+		names := "    "
+		if opt.short != "" {
+			names = "-" + opt.short + ", "
+		}
+		names = names + "--" + opt.long
+		if opt.arg != "" {
+			names = names + "=" + opt.arg
+		}
+		fmt.Fprintf(w, "  %-28s %s\n", names, opt.help)
+	}
+	fmt.Fprintf(w, "  %-28s %s\n", "-h, --help", "show this help")
+}
+
+// usageError reports a mistake in the command line, and returns the exit
+// code for it.
+func (c *command) usageError(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, "takeown %s: %s\n", c.name, fmt.Sprintf(format, args...))
+	fmt.Fprintf(os.Stderr, "Try 'takeown %s --help' for more information.\n", c.name)
+	return Usage
+}
+
+// parse parses the options of the command, which may come before, after or
+// among its arguments, GNU style.  Arguments after -- are never options.
+func (c *command) parse(args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := c.flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := c.flags.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	return positional, nil
+}
+
+// main runs the command with the arguments that follow its name.
+func (c *command) main(args []string) int {
+	args, err := c.parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		c.help(os.Stdout)
+		return Success
+	} else if err != nil {
+		return c.usageError("%v", err)
+	}
+	if c.o.nul && c.o.filesFrom == "" {
+		return c.usageError("--null requires --files-from")
+	}
+	required := c.minArgs
+	if c.o.filesFrom != "" && required > 0 {
+		required--
+	}
+	if len(args) < required {
+		return c.usageError("missing arguments")
+	}
+	if c.name == "help" {
+		return c.run(&c.o, args, nil)
+	}
+	listed := c.o.setup()
+	return finish(c.run(&c.o, args, listed))
+}
+
+// newCommand creates a command without options.
+func newCommand(name string, synopsis string, brief string, summary string, minArgs int) *command {
+	c := &command{name: name, synopsis: synopsis, brief: brief, summary: summary, minArgs: minArgs}
+	c.flags = flag.NewFlagSet("takeown "+name, flag.ContinueOnError)
+	// Errors are reported by main.
+	c.flags.SetOutput(ioutil.Discard)
+	c.flags.Usage = func() {}
+	return c
+}
+
+// commonOpts adds the options every command takes.
+func (c *command) commonOpts() {
+	c.stringOpt(&c.o.format, "", "format", "FORMAT", "report results as text, json, or nul for NUL-separated fields")
+	c.stringOpt(&c.o.filesFrom, "", "files-from", "FILE", "also operate on the paths listed in FILE, one per line; - reads them from standard input")
+	c.boolOpt(&c.o.nul, "0", "null", "with --files-from, paths are terminated by NUL characters instead of newlines")
+	c.boolOpt(&c.o.noSandbox, "", "no-sandbox", "do not confine takeown to the paths it works on; only for the administrator")
+	c.boolOpt(&c.o.trace, "T", "trace", "show trace of internal execution; requires file /.trace to exist")
+	c.o.format = string(FormatText)
+}
+
+func takeCommand() *command {
+	c := newCommand("take", "[OPTION]... PATH...",
+		"take, give away or release ownership of files",
+		"Take ownership of files covered by a delegation, give it away to another\ndelegated user with --to, or hand it back with --release.",
+		1)
+	c.run = func(o *options, args []string, listed []string) int {
+		if o.release && o.to != "" {
+			return c.usageError("--release and --to are mutually exclusive")
+		}
+		opts := o.takeOptions()
+		paths := append(args, listed...)
+		o.sandbox(paths)
+		return takeOwnership(paths, opts)
+	}
+	c.boolOpt(&c.o.recursive, "r", "recursive", "take ownership recursively")
+	c.boolOpt(&c.o.simulate, "s", "simulate", "print what would be done instead of doing it")
+	c.boolOpt(&c.o.verbose, "v", "verbose", "print out the actions taken")
+	c.stringOpt(&c.o.mode, "m", "mode", "MODE", "restrict the mode of files to at most these bits")
+	c.stringOpt(&c.o.to, "", "to", "USER", "give ownership to USER instead of taking it; requires a dispatch delegation")
+	c.boolOpt(&c.o.release, "", "release", "hand files you own back to the user designated by their delegation")
+	c.boolOpt(&c.o.ignoreQuota, "", "ignore-quota", "do not check disk quotas; only for the administrator")
+	c.commonOpts()
+	return c
+}
+
+func grantCommand() *command {
+	c := newCommand("grant", "[OPTION]... USER PATH...",
+		"delegate taking ownership of files to a user",
+		"Delegate to USER the taking of ownership of files under each PATH, or of\neach PATH itself if it is a file.",
+		2)
+	c.run = func(o *options, args []string, listed []string) int {
+		grant := o.grant()
+		paths := append(args[1:], listed...)
+		o.sandbox(paths)
+		return addDelegation(args[0], paths, grant)
+	}
+	c.grantOpts()
+	c.commonOpts()
+	return c
+}
+
+// grantOpts adds the options that set the policies of grants.
+func (c *command) grantOpts() {
+	c.listOpt(&c.o.include, "include", "PATTERN", "only cover files matching PATTERN; may be repeated")
+	c.listOpt(&c.o.exclude, "exclude", "PATTERN", "do not cover files matching PATTERN; may be repeated")
+	c.stringOpt(&c.o.owners, "", "owners", "USERS", "only cover files owned by these users or UID ranges")
+	c.stringOpt(&c.o.maxFiles, "", "max-files", "N", "let the user take at most N files per run")
+	c.stringOpt(&c.o.maxBytes, "", "max-bytes", "SIZE", "let the user take at most SIZE bytes per run; K, M, G and T suffixes are accepted")
+	c.stringOpt(&c.o.maxDailyFiles, "", "max-daily-files", "N", "let the user take at most N files per day")
+	c.listOpt(&c.o.windows, "window", "WINDOW", "only let the user take files within WINDOW, such as Mon-Fri 22:00-06:00; may be repeated")
+	c.stringOpt(&c.o.timezone, "", "timezone", "ZONE", "the time zone of the windows, such as Europe/Berlin; the local time by default")
+	c.boolOpt(&c.o.dispatch, "", "dispatch", "let the user give ownership away to other delegated users")
+	c.boolOpt(&c.o.manage, "", "manage", "let the user add and revoke delegations under PATH; only for the administrator")
+	c.boolOpt(&c.o.once, "", "once", "let the user take ownership only once, after which the delegation is removed")
+	c.boolOpt(&c.o.allowRelease, "", "allow-release", "let the user hand files back to the owner of the directory")
+	c.stringOpt(&c.o.home, "", "home", "USER", "let the user hand files back to USER instead; implies --allow-release")
+	c.stringOpt(&c.o.fileMode, "", "file-mode", "MODE", "set MODE on files whose ownership is taken")
+	c.stringOpt(&c.o.dirMode, "", "dir-mode", "MODE", "set MODE on directories whose ownership is taken")
+	c.stringOpt(&c.o.umask, "", "umask", "MODE", "remove these mode bits from files whose ownership is taken")
+	c.stringOpt(&c.o.acl, "", "acl", "POLICY", "policy for POSIX ACLs of files whose ownership is taken: strip, rewrite or inherit")
+}
+
+func revokeCommand() *command {
+	c := newCommand("revoke", "[OPTION]... USER PATH...",
+		"revoke delegations",
+		"Remove the delegations to USER established on each PATH.",
+		2)
+	c.run = func(o *options, args []string, listed []string) int {
+		paths := append(args[1:], listed...)
+		o.sandbox(paths)
+		return deleteDelegation(args[0], paths)
+	}
+	c.commonOpts()
+	return c
+}
+
+// pathsOrCwd returns the paths passed, or the current directory if none
+// were passed at all.
+func pathsOrCwd(o *options, args []string, listed []string) []string {
+	paths := append(args, listed...)
+	if len(paths) == 0 && o.filesFrom == "" {
+		paths = []string{"."}
+	}
+	return paths
+}
+
+func listCommand() *command {
+	c := newCommand("list", "[OPTION]... [PATH]...",
+		"list the delegations covering paths",
+		"List the delegations that cover each PATH, or the current directory.",
+		0)
+	c.run = func(o *options, args []string, listed []string) int {
+		paths := pathsOrCwd(o, args, listed)
+		o.sandbox(paths)
+		return listDelegations(paths)
+	}
+	c.commonOpts()
+	return c
+}
+
+func explainCommand() *command {
+	c := newCommand("explain", "[OPTION]... [PATH]...",
+		"explain which delegations cover paths, and why",
+		"Explain which delegations cover each PATH, or the current directory, and\nwhy.  Users other than the administrator only see their own delegations.",
+		0)
+	c.run = func(o *options, args []string, listed []string) int {
+		paths := pathsOrCwd(o, args, listed)
+		o.sandbox(paths)
+		return explain(paths)
+	}
+	c.commonOpts()
+	return c
+}
+
+func requestCommand() *command {
+	c := newCommand("request", "[OPTION]... PATH...",
+		"request a delegation from the administrator",
+		"Request a delegation on each PATH from the administrator, or from the grant\nmanagers of the PATH.",
+		1)
+	c.run = func(o *options, args []string, listed []string) int {
+		if o.reason == "" {
+			return c.usageError("--reason is required")
+		}
+		if err := CheckReason(o.reason); err != nil {
+			return c.usageError("%v", err)
+		}
+		paths := append(args, listed...)
+		o.sandbox(paths)
+		return requestDelegation(paths, o.reason)
+	}
+	c.stringOpt(&c.o.reason, "", "reason", "TEXT", "why you need the delegation")
+	c.commonOpts()
+	return c
+}
+
+func pendingCommand() *command {
+	c := newCommand("pending", "[OPTION]...",
+		"list pending requests for delegations",
+		"List the pending requests for delegations you may approve or reject.",
+		0)
+	c.run = func(o *options, args []string, listed []string) int {
+		if len(args) > 0 || len(listed) > 0 {
+			return c.usageError("too many arguments")
+		}
+		o.sandbox(nil)
+		return listPendingRequests()
+	}
+	c.commonOpts()
+	return c
+}
+
+func approveCommand() *command {
+	c := newCommand("approve", "[OPTION]... ID...",
+		"approve requests for delegations",
+		"Approve the requests for delegations with each ID, establishing the\ndelegations with the policies set by the options.",
+		1)
+	c.run = func(o *options, args []string, listed []string) int {
+		grant := o.grant()
+		o.sandbox(nil)
+		return decideRequests(append(args, listed...), true, grant)
+	}
+	c.grantOpts()
+	c.commonOpts()
+	return c
+}
+
+func rejectCommand() *command {
+	c := newCommand("reject", "[OPTION]... ID...",
+		"reject requests for delegations",
+		"Reject the requests for delegations with each ID.",
+		1)
+	c.run = func(o *options, args []string, listed []string) int {
+		o.sandbox(nil)
+		return decideRequests(append(args, listed...), false, Grant{})
+	}
+	c.commonOpts()
+	return c
+}
+
+func requestsCommand() *command {
+	c := newCommand("requests", "[OPTION]...",
+		"list your requests for delegations",
+		"List your requests for delegations, and what became of them.",
+		0)
+	c.run = func(o *options, args []string, listed []string) int {
+		if len(args) > 0 || len(listed) > 0 {
+			return c.usageError("too many arguments")
+		}
+		o.sandbox(nil)
+		return listOwnRequests()
+	}
+	c.commonOpts()
+	return c
+}
+
+func applyCommand() *command {
+	c := newCommand("apply", "[OPTION]... MANIFEST",
+		"apply a manifest of delegations",
+		"Establish the delegations declared in MANIFEST on the paths it lists, and\nrevoke the others on those paths, all or nothing.  A MANIFEST of - is read\nfrom standard input.",
+		1)
+	c.run = func(o *options, args []string, listed []string) int {
+		if len(args) > 1 || len(listed) > 0 {
+			return c.usageError("too many arguments")
+		}
+		m := o.manifest(args[0])
+		o.sandbox(m.paths())
+		return applyManifest(m, o.check)
+	}
+	c.boolOpt(&c.o.check, "", "check", "only show how the delegations differ from MANIFEST, exiting with status 1 if they do")
+	c.commonOpts()
+	return c
+}
+
+func findCommand(name string) *command {
+	switch name {
+	case "take":
+		return takeCommand()
+	case "grant":
+		return grantCommand()
+	case "revoke":
+		return revokeCommand()
+	case "list":
+		return listCommand()
+	case "explain":
+		return explainCommand()
+	case "find":
+		return findDelegationsCommand()
+	case "request":
+		return requestCommand()
+	case "pending":
+		return pendingCommand()
+	case "approve":
+		return approveCommand()
+	case "reject":
+		return rejectCommand()
+	case "requests":
+		return requestsCommand()
+	case "apply":
+		return applyCommand()
+	case "help":
+		return helpCommand()
+	}
+	return nil
+}
+
+var commandNames = []string{"take", "grant", "revoke", "list", "explain", "find", "request", "pending", "approve", "reject", "requests", "apply", "help"}
+
+// listCommands prints the commands along with what each does.
+func listCommands(w io.Writer) {
+	fmt.Fprintf(w, "Commands:\n")
+	for _, name := range commandNames {
+		fmt.Fprintf(w, "  %-9s %s\n", name, findCommand(name).brief)
+	}
+}
+
+func findDelegationsCommand() *command {
+	c := newCommand("find", "[OPTION]... [PATH]...",
+		"find the delegations established in directory trees",
+		"Find the delegations established on each PATH, or the current directory,\nand on everything under it.",
+		0)
+	c.run = func(o *options, args []string, listed []string) int {
+		paths := pathsOrCwd(o, args, listed)
+		o.sandbox(paths)
+		return findDelegations(paths, o.user)
+	}
+	c.stringOpt(&c.o.user, "u", "user", "USER", "only find the delegations to USER")
+	c.commonOpts()
+	return c
+}
+
+func helpCommand() *command {
+	c := newCommand("help", "[COMMAND]",
+		"show the help of a command",
+		"Show the help of COMMAND, or list the commands.",
+		0)
+	c.run = func(o *options, args []string, listed []string) int {
+		if len(args) > 1 {
+			return c.usageError("too many arguments")
+		}
+		if len(args) == 1 {
+			cmd := findCommand(args[0])
+			if cmd == nil {
+				return c.usageError("unknown command %s", args[0])
+			}
+			cmd.help(os.Stdout)
+			return Success
+		}
+		fmt.Printf("Usage: takeown COMMAND [OPTION]... [ARGUMENT]...\n\n")
+		listCommands(os.Stdout)
+		fmt.Printf("\nRun 'takeown help COMMAND' for the options of each command.\n")
+		return Success
+	}
+	return c
+}
@@ -3,11 +3,19 @@ package main
 import (
 	"fmt"
 	"os"
+	"syscall"
 )
 
-func addDelegation(username string, paths []string) (retval int) {
+// addDelegation establishes a grant for the user on each path.  The grant
+// carries the policies in the template.
+func addDelegation(username string, paths []string, template Grant) (retval int) {
 	trace("pathnames passed: %q", paths)
-	dropToCallingUser()
+	if isAdmin() {
+		if err := dropToCallingUser(); err != nil {
+			fmt.Fprintf(os.Stderr, "error dropping privileges: %v\n", err)
+			return OperationError
+		}
+	}
 
 	uid, err := userToUidOrStringUid(PotentialUsername(username))
 	if err != nil {
@@ -15,17 +23,69 @@ func addDelegation(username string, paths []string) (retval int) {
 		retval = OperationError
 		return
 	}
+	grant := template
+	grant.UID = uid
 	table := NewUNIXGrantTable()
 	for _, file := range paths {
-		err := table.Add(file, UID(uid))
+		target, err := openGrantTarget(file)
+		if err == nil {
+			err = checkManager(table, target, grant)
+			if err == nil {
+				err = table.Add(target, grant)
+			}
+			target.Close()
+		}
+		audit(AuditEvent{
+			Action:     auditAddGrant,
+			Path:       file,
+			Delegation: &auditDelegation{Path: file, Grant: grantRecord(grant)},
+			Result:     auditResult(err),
+		})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error adding delegation for user %s on path %s: %v\n", username, file, err)
-			retval = OperationError
+			status := OperationError
 			if IsPermission(err) {
-				retval = PermissionDenied
+				status = PermissionDenied
 			}
+			reportError(auditAddGrant, file, status, fmt.Sprintf("error adding delegation for user %s on path %s: %v", username, file, err), err)
+			retval = status
 			continue
 		}
+		report(Result{Action: auditAddGrant, Path: file, Status: Success}, false)
 	}
 	return
 }
+
+// checkManager lets users other than the administrator change delegations
+// on a target only if they manage delegations there.  That they can see the
+// target was checked when it was opened.  Grants that carry the right to
+// manage delegations can only be given, changed or revoked by the
+// administrator.  The grant passed is the one to be added, or the one to be
+// revoked, which only needs its UID.
+func checkManager(table *UNIXGrantTable, target *grantTarget, grant Grant) error {
+	if isAdmin() {
+		return nil
+	}
+	caller := UID(os.Getuid())
+	if grant.Manage {
+		return syscall.EPERM
+	}
+	path := target.real
+	manager, err := table.Manager(path, caller)
+	if err != nil {
+		return err
+	}
+	if manager == nil {
+		trace("  %d does not manage delegations on %s", caller, path)
+		return syscall.EPERM
+	}
+	held, err := table.Held(target, grant.UID)
+	if err != nil {
+		return err
+	}
+	if held != nil && held.Manage {
+		trace("  %d cannot change the delegation of manager %d on %s", caller, grant.UID, path)
+		return syscall.EPERM
+	}
+	trace("  %d manages delegations on %s via %s", caller, path, manager.Path)
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// loadManifest reads the manifest with the file system credentials of the
+// calling user, and parses it.  The name - stands for standard input.  On
+// errors, it also returns the exit status they call for.
+func loadManifest(name string) (*Manifest, int, error) {
+	var data []byte
+	err := asCallingUser(func() error {
+		var err error
+		if name == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(name)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, OperationError, fmt.Errorf("error reading manifest %s: %v", name, err)
+	}
+	m, err := ParseManifest(name, data)
+	if err != nil {
+		return nil, Usage, err
+	}
+	return m, Success, nil
+}
+
+// paths returns the paths the manifest lists.
+func (m *Manifest) paths() []string {
+	paths := []string{}
+	for _, p := range m.Paths {
+		paths = append(paths, p.Path)
+	}
+	return paths
+}
+
+// applyManifest makes the delegations on the paths the manifest lists
+// match it, reporting every change.  Either all changes are made, or none
+// are: should writing the delegations on a path fail, those already written
+// on other paths are put back.  Users other than the administrator may only
+// apply manifests changing delegations they could change themselves.  If
+// check is set, the changes are only reported, and the exit status is
+// Drift if there are any.
+func applyManifest(m *Manifest, check bool) (retval int) {
+	trace("applying manifest %s, check %t", m.Name, check)
+	verb := "applying"
+	if check || isAdmin() {
+		if err := dropToCallingUser(); err != nil {
+			fmt.Fprintf(os.Stderr, "error dropping privileges: %v\n", err)
+			return OperationError
+		}
+	}
+	if check {
+		verb = "checking"
+	} else {
+		// No other run may change the delegations on the paths between
+		// the comparison and the changes.
+		lock, err := lockGrants()
+		if err != nil {
+			reportError("apply", m.Name, OperationError, fmt.Sprintf("error applying manifest %s: %v", m.Name, err), err)
+			return OperationError
+		}
+		defer lock.Close()
+	}
+
+	plans, err := m.Plan()
+	if err != nil {
+		status := OperationError
+		if IsPermission(err) {
+			status = PermissionDenied
+		}
+		reportError("apply", m.Name, status, fmt.Sprintf("error %s manifest %s: %v", verb, m.Name, err), err)
+		return status
+	}
+	defer closePlans(plans)
+	changes := []manifestChange{}
+	for _, plan := range plans {
+		changes = append(changes, plan.Changes...)
+	}
+	for _, c := range changes {
+		report(Result{Action: "apply", Path: c.Path, Status: Success, Message: c.String()}, true)
+	}
+	if check {
+		if len(changes) > 0 {
+			return Drift
+		}
+		return Success
+	}
+
+	table := NewUNIXGrantTable()
+	for _, plan := range plans {
+		for _, c := range plan.Changes {
+			// The check is made on the file the plan writes to.
+			if err := checkManager(table, plan.target, c.grant()); err != nil {
+				auditManifestChange(c, err)
+				status := OperationError
+				if IsPermission(err) {
+					status = PermissionDenied
+				}
+				reportError("apply", c.Path, status, fmt.Sprintf("error applying manifest %s: cannot %s: %v", m.Name, c, err), err)
+				return status
+			}
+		}
+	}
+
+	written := []PathPlan{}
+	for _, plan := range plans {
+		if len(plan.Changes) == 0 {
+			continue
+		}
+		if err := plan.target.SetGrants(plan.Grants); err != nil {
+			for _, c := range plan.Changes {
+				auditManifestChange(c, err)
+			}
+			message := fmt.Sprintf("error applying manifest %s: %v", m.Name, err)
+			if rollBack(written) {
+				message = message + "; no delegations were changed"
+			}
+			reportError("apply", plan.Path, OperationError, message, err)
+			return OperationError
+		}
+		written = append(written, plan)
+	}
+	for _, c := range changes {
+		auditManifestChange(c, nil)
+	}
+	return Success
+}
+
+// rollBack puts back the grants on the paths as they were before the
+// plans were carried out, latest first.  It returns false if it could not
+// put back all of them.
+func rollBack(written []PathPlan) bool {
+	ok := true
+	for n := len(written) - 1; n >= 0; n-- {
+		plan := written[n]
+		if err := plan.target.setAttr(plan.original); err != nil {
+			reportError("apply", plan.Path, OperationError, fmt.Sprintf("error rolling back delegations on %s: %v", plan.Path, err), err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func auditManifestChange(c manifestChange, err error) {
+	action := auditAddGrant
+	if c.New == nil {
+		action = auditDeleteGrant
+	}
+	audit(AuditEvent{
+		Action:     action,
+		Path:       c.Path,
+		Delegation: &auditDelegation{Path: c.Path, Grant: grantRecord(c.grant())},
+		Result:     auditResult(err),
+	})
+}
@@ -7,7 +7,12 @@ import (
 
 func deleteDelegation(username string, paths []string) (retval int) {
 	trace("pathnames passed: %q", paths)
-	dropToCallingUser()
+	if isAdmin() {
+		if err := dropToCallingUser(); err != nil {
+			fmt.Fprintf(os.Stderr, "error dropping privileges: %v\n", err)
+			return OperationError
+		}
+	}
 
 	uid, err := userToUidOrStringUid(PotentialUsername(username))
 	if err != nil {
@@ -17,15 +22,30 @@ func deleteDelegation(username string, paths []string) (retval int) {
 	}
 	table := NewUNIXGrantTable()
 	for _, file := range paths {
-		err := table.Remove(file, UID(uid))
+		target, err := openGrantTarget(file)
+		if err == nil {
+			err = checkManager(table, target, Grant{UID: uid})
+			if err == nil {
+				err = table.Remove(target, UID(uid))
+			}
+			target.Close()
+		}
+		audit(AuditEvent{
+			Action:     auditDeleteGrant,
+			Path:       file,
+			Delegation: &auditDelegation{Path: file, Grant: grantRecord(Grant{UID: uid})},
+			Result:     auditResult(err),
+		})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error removing delegation for user %s on path %s: %v\n", username, file, err)
-			retval = OperationError
+			status := OperationError
 			if IsPermission(err) {
-				retval = PermissionDenied
+				status = PermissionDenied
 			}
+			reportError(auditDeleteGrant, file, status, fmt.Sprintf("error removing delegation for user %s on path %s: %v", username, file, err), err)
+			retval = status
 			continue
 		}
+		report(Result{Action: auditDeleteGrant, Path: file, Status: Success}, false)
 	}
 	return
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// explain tells, for each path, which delegations cover it and why.  Users
+// other than the administrator only get to see their own delegations.
+func explain(paths []string) (retval int) {
+	trace("pathnames passed: %q", paths)
+	if err := dropToCallingUser(); err != nil {
+		fmt.Fprintf(os.Stderr, "error dropping privileges: %v\n", err)
+		return OperationError
+	}
+
+	myuid := UID(os.Getuid())
+	table := NewUNIXGrantTable()
+	for _, path := range paths {
+		explanations, err := table.Explain(path)
+		if err != nil {
+			status := OperationError
+			if IsPermission(err) {
+				status = PermissionDenied
+			}
+			reportError("explain", path, status, fmt.Sprintf("error loading delegations for %s: %v", path, err), err)
+			retval = status
+			continue
+		}
+		stated, err := lstat(path)
+		if err != nil {
+			reportError("explain", path, OperationError, fmt.Sprintf("error explaining delegations for %s: %v", path, err), err)
+			retval = OperationError
+			continue
+		}
+		r := Result{Action: "explain", Path: path, Status: Success}
+		lines := []string{fmt.Sprintf("%s:", path)}
+		applied := make(map[UID]bool)
+		for _, e := range explanations {
+			if !isAdmin() && e.UID != myuid {
+				continue
+			}
+			verdict := e.Reason
+			if e.Covers {
+				if applied[e.UID] {
+					verdict = verdict + ", but overridden by a closer delegation"
+				} else if len(e.Owners) > 0 && !e.Owners.Has(UID(stated.Uid)) {
+					verdict = verdict + ", but " + ownerNotAllowed(UID(stated.Uid)).Error()
+				} else {
+					verdict = verdict + ", applies"
+				}
+				applied[e.UID] = true
+			}
+			line := fmt.Sprintf("%s: via %s: %s", uidToUserOrStringifiedUid(e.UID), e.Delegation, verdict)
+			lines = append(lines, "\t"+line)
+			r.Delegations = append(r.Delegations, newResultDelegation(e.Delegation, verdict))
+		}
+		if len(r.Delegations) == 0 {
+			lines = append(lines, "\tno delegations")
+		}
+		r.Message = strings.Join(lines, "\n")
+		report(r, true)
+	}
+	return
+}
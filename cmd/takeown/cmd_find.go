@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// findDelegations reports the delegations established on each path and on
+// everything under it.  If username is not empty, only delegations to that
+// user are reported.
+func findDelegations(paths []string, username string) (retval int) {
+	trace("pathnames passed: %q", paths)
+	if err := dropToCallingUser(); err != nil {
+		fmt.Fprintf(os.Stderr, "error dropping privileges: %v\n", err)
+		return OperationError
+	}
+
+	var only *UID
+	if username != "" {
+		uid, err := userToUidOrStringUid(PotentialUsername(username))
+		if err != nil {
+			reportError("find", username, OperationError, fmt.Sprintf("error determining UID for user %s: %v", username, err), err)
+			return OperationError
+		}
+		only = &uid
+	}
+
+	table := NewUNIXGrantTable()
+	for _, path := range paths {
+		real, err := realpath(path)
+		if err != nil {
+			reportError("find", path, OperationError, fmt.Sprintf("error finding delegations under %s: %v", path, err), err)
+			retval = retval | OperationError
+			continue
+		}
+		filepath.WalkDir(real, func(p string, dentry fs.DirEntry, err error) error {
+			if err != nil {
+				status := OperationError
+				if IsPermission(err) {
+					status = PermissionDenied
+				}
+				reportError("find", p, status, fmt.Sprintf("error finding delegations under %s: %v", p, err), err)
+				retval = retval | status
+				return nil
+			}
+			if dentry.Type()&fs.ModeSymlink != 0 {
+				return nil
+			}
+			delegations, err := table.Established(p, !dentry.IsDir())
+			if err != nil {
+				status := OperationError
+				if IsPermission(err) {
+					status = PermissionDenied
+				}
+				reportError("find", p, status, fmt.Sprintf("error loading delegations for %s: %v", p, err), err)
+				retval = retval | status
+				return nil
+			}
+			r := Result{Action: "find", Path: p, Status: Success}
+			lines := []string{}
+			for _, d := range delegations {
+				if only != nil && d.UID != *only {
+					continue
+				}
+				line := fmt.Sprintf("%s: via %s", uidToUserOrStringifiedUid(d.UID), d)
+				lines = append(lines, line)
+				r.Delegations = append(r.Delegations, newResultDelegation(d, ""))
+			}
+			if len(lines) == 0 {
+				return nil
+			}
+			r.Message = strings.Join(lines, "\n")
+			report(r, true)
+			return nil
+		})
+	}
+	return
+}
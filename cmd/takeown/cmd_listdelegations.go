@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -15,36 +16,55 @@ func uidstonames(u UIDList) map[UID]string {
 	return result
 }
 
-func keys(m map[UID][]string) UIDList {
+// keys returns the users in the table, ordered by UID.
+func keys(m map[UID][]Delegation) UIDList {
 	r := UIDList{}
 	for key := range m {
 		r = append(r, key)
 	}
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
 	return r
 }
 
 func listDelegations(paths []string) (retval int) {
 	trace("pathnames passed: %q", paths)
-	dropToCallingUser()
+	if err := dropToCallingUser(); err != nil {
+		fmt.Fprintf(os.Stderr, "error dropping privileges: %v\n", err)
+		return OperationError
+	}
 
 	table := NewUNIXGrantTable()
 	for _, path := range paths {
 		table, err := table.Table(path)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error loading delegations for %s: %v\n", path, err)
-			retval = OperationError
+			status := OperationError
 			if IsPermission(err) {
-				retval = PermissionDenied
+				status = PermissionDenied
 			}
+			reportError("list", path, status, fmt.Sprintf("error loading delegations for %s: %v", path, err), err)
+			retval = status
 			continue
 		}
+		r := Result{Action: "list", Path: path, Status: Success}
 		if len(table) > 0 {
-			fmt.Printf("%s:\n", path)
-			uname := uidstonames(keys(table))
-			for uid, p := range table {
-				fmt.Printf("\t%s: via %s\n", uname[uid], strings.Join(p, ", "))
+			lines := []string{fmt.Sprintf("%s:", path)}
+			uids := keys(table)
+			uname := uidstonames(uids)
+			for _, uid := range uids {
+				p := table[uid]
+				via := []string{}
+				for _, d := range p {
+					via = append(via, d.String())
+				}
+				line := fmt.Sprintf("%s: via %s", uname[uid], strings.Join(via, ", "))
+				lines = append(lines, "\t"+line)
+				for _, d := range p {
+					r.Delegations = append(r.Delegations, newResultDelegation(d, ""))
+				}
 			}
+			r.Message = strings.Join(lines, "\n")
 		}
+		report(r, true)
 	}
 	return
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// openSpoolOrReport opens the spool, reporting the error if it cannot.
+func openSpoolOrReport() (*RequestSpool, int) {
+	spool, err := OpenSpool()
+	if err != nil {
+		reportError("spool", SPOOLFILE, OperationError, fmt.Sprintf("error opening request spool: %v", err), err)
+		return nil, OperationError
+	}
+	return spool, Success
+}
+
+// requestDelegation records a pending request from the calling user for a
+// delegation on each path.  The paths must be visible to the user.
+func requestDelegation(paths []string, reason string) (retval int) {
+	trace("pathnames passed: %q", paths)
+	spool, retval := openSpoolOrReport()
+	if spool == nil {
+		return
+	}
+	defer spool.Close()
+
+	caller := UID(os.Getuid())
+	for _, path := range paths {
+		var r *DelegationRequest
+		target, err := openGrantTarget(path)
+		if err == nil {
+			r, err = spool.Add(caller, target.real, target.fs, reason)
+			target.Close()
+		}
+		if err == nil {
+			err = spool.Save()
+		}
+		event := AuditEvent{Action: auditRequest, Path: path, Result: auditResult(err)}
+		if r != nil {
+			event.Request = r.ID
+		}
+		audit(event)
+		if err != nil {
+			status := OperationError
+			if IsPermission(err) || errors.Is(err, os.ErrPermission) {
+				status = PermissionDenied
+			}
+			reportError(auditRequest, path, status, fmt.Sprintf("error requesting delegation on %s: %v", path, err), err)
+			retval = status
+			continue
+		}
+		report(Result{Action: auditRequest, Path: path, Status: Success, Message: fmt.Sprintf("requested delegation on %s as request %d", path, r.ID), Request: r}, true)
+	}
+	return
+}
+
+// listPendingRequests lists the pending requests the calling user may
+// approve or reject: all of them for the administrator, and those on paths
+// they manage for grant managers.
+func listPendingRequests() (retval int) {
+	spool, retval := openSpoolOrReport()
+	if spool == nil {
+		return
+	}
+	defer spool.Close()
+
+	table := NewUNIXGrantTable()
+	for n, r := range spool.Requests {
+		if r.Status != RequestPending {
+			continue
+		}
+		target, err := openGrantTarget(r.Path)
+		if err == nil {
+			err = checkManager(table, target, Grant{UID: r.UID})
+			target.Close()
+		}
+		if err != nil {
+			trace("  not listing request %d: %v", r.ID, err)
+			continue
+		}
+		report(Result{Action: "pending", Path: r.Path, Status: Success, Message: r.String(), Request: &spool.Requests[n]}, true)
+	}
+	return
+}
+
+// listOwnRequests lists the requests of the calling user, and what became
+// of them.
+func listOwnRequests() (retval int) {
+	spool, retval := openSpoolOrReport()
+	if spool == nil {
+		return
+	}
+	defer spool.Close()
+	if err := dropToCallingUser(); err != nil {
+		fmt.Fprintf(os.Stderr, "error dropping privileges: %v\n", err)
+		return OperationError
+	}
+
+	caller := UID(os.Getuid())
+	for n, r := range spool.Requests {
+		if r.UID != caller {
+			continue
+		}
+		status := string(r.Status)
+		if r.DecidedBy != nil {
+			status = fmt.Sprintf("%s by %s", r.Status, uidToUserOrStringifiedUid(*r.DecidedBy))
+		}
+		report(Result{Action: "requests", Path: r.Path, Status: Success, Message: fmt.Sprintf("request %d on %s: %s", r.ID, r.Path, status), Request: &spool.Requests[n]}, true)
+	}
+	return
+}
+
+// decideRequests approves or rejects the requests with the IDs.  Approving
+// a request establishes a grant for the requester on the path, with the
+// policies in the template, provided the path is still the file or
+// directory requested.  Users other than the administrator may only
+// decide requests on paths they manage.
+func decideRequests(ids []string, approve bool, template Grant) (retval int) {
+	action, verb, past := auditReject, "rejecting", RequestRejected
+	if approve {
+		action, verb, past = auditAddGrant, "approving", RequestApproved
+	}
+	spool, retval := openSpoolOrReport()
+	if spool == nil {
+		return
+	}
+	defer spool.Close()
+
+	caller := UID(os.Getuid())
+	table := NewUNIXGrantTable()
+	for _, id := range ids {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			reportError(action, id, Usage, fmt.Sprintf("error %s request %s: invalid request ID", verb, id), err)
+			retval = Usage
+			continue
+		}
+		r := spool.Find(n)
+		if r == nil {
+			err := fmt.Errorf("no such request")
+			reportError(action, id, OperationError, fmt.Sprintf("error %s request %s: %v", verb, id, err), err)
+			retval = OperationError
+			continue
+		}
+		if r.Status != RequestPending {
+			err := fmt.Errorf("request is already %s", r.Status)
+			reportError(action, r.Path, OperationError, fmt.Sprintf("error %s request %d: %v", verb, r.ID, err), err)
+			retval = OperationError
+			continue
+		}
+
+		grant := template
+		grant.UID = r.UID
+		var target *grantTarget
+		if approve {
+			target, err = r.Open()
+		} else {
+			target, err = openGrantTarget(r.Path)
+		}
+		if err == nil {
+			err = checkManager(table, target, grant)
+			if err == nil && approve {
+				err = table.Add(target, grant)
+			}
+			target.Close()
+		}
+		if err == nil {
+			spool.Decide(r, past, caller)
+			err = spool.Save()
+		}
+		event := AuditEvent{Action: action, Path: r.Path, Request: r.ID, Result: auditResult(err)}
+		if approve {
+			event.Delegation = &auditDelegation{Path: r.Path, Grant: grantRecord(grant)}
+		}
+		audit(event)
+		if err != nil {
+			status := OperationError
+			if IsPermission(err) {
+				status = PermissionDenied
+			}
+			reportError(action, r.Path, status, fmt.Sprintf("error %s request %d: %v", verb, r.ID, err), err)
+			retval = status
+			continue
+		}
+		report(Result{Action: action, Path: r.Path, Status: Success, Message: fmt.Sprintf("%s request %d from %s on %s", past, r.ID, uidToUserOrStringifiedUid(r.UID), r.Path), Request: r}, true)
+	}
+	return
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,22 +13,229 @@ type sinfo struct {
 	Gid  uint32
 	Dir  bool
 	Link bool
+	Mode FileMode
+	Dev  uint64
+	Ino  uint64
+	// Space is the disk space the file uses, in bytes.
+	Space uint64
 }
 
-func _takeOwnership(file string, table GrantTable, myuid UID, simulate bool, fileVisibleToUser bool, verbose bool) (retval int) {
-	trace("_takeOwnership %s, myuid %d, simulate %t, fileVisibleToUser %t", file, myuid, simulate, fileVisibleToUser)
+// takeOptions govern how ownership of files is taken.
+type takeOptions struct {
+	Recursive bool
+	Simulate  bool
+	Verbose   bool
+	// Mask restricts the mode files get to these bits.
+	Mask FileMode
+	// To is the user that receives ownership of the files.  Unless
+	// ownership is being given away, it is the calling user.
+	To UID
+	// Release hands files owned by the calling user back to the user
+	// designated by the delegation covering them, ignoring To.
+	Release bool
+	// IgnoreQuota skips checking the disk quota of the receiving user.
+	IgnoreQuota bool
+	// tally, when set, makes _takeOwnership total the files that would
+	// change hands, instead of changing them.
+	tally *tally
+	// done, when set, totals the files that did change hands.
+	done *tally
+	// unmeasured, when set, makes _takeOwnership change files without
+	// them having been totalled first, until it meets a change that
+	// must be.
+	unmeasured *unmeasured
+	// handled holds the results for the paths handled before the run
+	// had to start over, which are then skipped.
+	handled map[string]int
+}
+
+// unmeasured follows a run that changes files without totalling them
+// first.
+type unmeasured struct {
+	// quotas records, per file system, whether the receiving user may
+	// have a disk quota on it.
+	quotas map[uint64]bool
+	// stopped is set once a change that must be totalled was met.
+	stopped bool
+	// handled holds the results for the paths handled until then.
+	handled map[string]int
+}
+
+// mustMeasure returns true if a change must be totalled before any is made,
+// as the delegations authorizing it carry limits or are good for one change
+// only, or as the receiving user has a disk quota on the file system.
+func (u *unmeasured) mustMeasure(file string, stated sinfo, opts takeOptions, delegations ...*Delegation) bool {
+	for _, d := range delegations {
+		if d != nil && (d.Limits != nil || d.Once) {
+			return true
+		}
+	}
+	if opts.Release || opts.IgnoreQuota {
+		return false
+	}
+	quota, ok := u.quotas[stated.Dev]
+	if !ok {
+		dir := file
+		if !stated.Dir {
+			dir = filepath.Dir(file)
+		}
+		q, err := GetQuota(dir, opts.To)
+		// Errors are reported once the files are totalled.
+		quota = err != nil || q != nil
+		u.quotas[stated.Dev] = quota
+	}
+	return quota
+}
+
+// errMustMeasure stops walks that met a change that must be totalled.
+var errMustMeasure = errors.New("change must be totalled first")
+
+// tally totals the files that would change hands, per file system, and per
+// delegation carrying limits.  Files with several hard links are counted
+// once.
+type tally struct {
+	seen      map[[2]uint64]bool
+	transfers map[uint64]*Transfer
+	devices   []uint64
+	limited   map[string]*Transfer
+	// delegations lists the delegations carrying limits, or good for one
+	// change only, in the order
+	// they were first used.
+	delegations []*Delegation
+}
+
+func newTally() *tally {
+	return &tally{make(map[[2]uint64]bool), make(map[uint64]*Transfer), []uint64{}, make(map[string]*Transfer), []*Delegation{}}
+}
+
+// add counts the file.  If the change is authorized by delegations, they
+// are passed as well, so their limits can be checked.
+func (t *tally) add(file string, stated sinfo, delegations ...*Delegation) {
+	if t.seen[[2]uint64{stated.Dev, stated.Ino}] {
+		return
+	}
+	t.seen[[2]uint64{stated.Dev, stated.Ino}] = true
+	for _, d := range delegations {
+		if d == nil || d.Limits == nil && !d.Once {
+			continue
+		}
+		used, ok := t.limited[usageKey(*d)]
+		if !ok {
+			used = &Transfer{Path: d.Path}
+			t.limited[usageKey(*d)] = used
+			t.delegations = append(t.delegations, d)
+		}
+		used.Bytes += stated.Space
+		used.Inodes++
+	}
+	tr, ok := t.transfers[stated.Dev]
+	if !ok {
+		dir := file
+		if !stated.Dir {
+			dir = filepath.Dir(file)
+		}
+		tr = &Transfer{Path: dir}
+		t.transfers[stated.Dev] = tr
+		t.devices = append(t.devices, stated.Dev)
+	}
+	tr.Bytes += stated.Space
+	tr.Inodes++
+}
+
+// total returns the sum of the transfers across all file systems.
+func (t *tally) total() *Transfer {
+	total := &Transfer{}
+	for _, tr := range t.transfers {
+		total.Bytes += tr.Bytes
+		total.Inodes += tr.Inodes
+	}
+	return total
+}
+
+// verb words the messages about an ownership change.
+type verb struct {
+	base   string
+	past   string
+	gerund string
+}
+
+var (
+	taking    = verb{"take", "took", "taking"}
+	giving    = verb{"give", "gave", "giving"}
+	releasing = verb{"release", "released", "releasing"}
+)
+
+var targetNotDelegated = errors.New("target user holds no delegation covering the file")
+
+var delegationUsedUp = errors.New("one-shot delegation already used")
+
+func ownerNotAllowed(owner UID) error {
+	return fmt.Errorf("delegation does not cover files owned by %s", uidToUserOrStringifiedUid(owner))
+}
+
+func targetOwnerNotAllowed(owner UID) error {
+	return fmt.Errorf("delegation of the target user does not cover files owned by %s", uidToUserOrStringifiedUid(owner))
+}
+
+func _takeOwnership(file string, table GrantTable, myuid UID, opts takeOptions, fileVisibleToUser bool) (retval int) {
+	trace("_takeOwnership %s, myuid %d, to %d, release %t, simulate %t, fileVisibleToUser %t", file, myuid, opts.To, opts.Release, opts.Simulate, fileVisibleToUser)
+
+	v := taking
+	if opts.Release {
+		v = releasing
+	} else if opts.To != myuid {
+		v = giving
+	}
 
 	// Look up file in table.
-	uids, err := table.ForPath(file)
+	delegation, err := table.Lookup(file, myuid)
 	if err != nil {
 		trace("  _takeownership error looking up in table: %v", err)
 		if !fileVisibleToUser {
 			return Success
 		}
-		fmt.Fprintf(os.Stderr, "error querying delegations for %s: %v\n", file, err)
+		reportError(v.base, file, OperationError, fmt.Sprintf("error querying delegations for %s: %v", file, err), err)
 		return OperationError
 	}
 
+	// Work out who receives ownership of the file.
+	to := opts.To
+	what := fmt.Sprintf("ownership of %s", file)
+	if v == releasing {
+		if delegation != nil && delegation.Release {
+			to, err = delegation.ReleaseTarget()
+			if err != nil {
+				trace("  _takeownership error determining release target: %v", err)
+				if !fileVisibleToUser {
+					return Success
+				}
+				reportError(v.base, file, OperationError, fmt.Sprintf("error %s %s: %v", v.gerund, what, err), err)
+				return OperationError
+			}
+			what = fmt.Sprintf("ownership of %s to %s", file, uidToUserOrStringifiedUid(to))
+		}
+	} else if v == giving {
+		what = fmt.Sprintf("ownership of %s to %s", file, uidToUserOrStringifiedUid(to))
+	}
+
+	// When giving ownership away, the policies that apply are the ones of
+	// the delegation that covers the file for the receiving user.  Files
+	// released keep their mode and ACLs.
+	received := delegation
+	if v == giving {
+		received, err = table.Lookup(file, to)
+		if err != nil {
+			trace("  _takeownership error looking up in table: %v", err)
+			if !fileVisibleToUser {
+				return Success
+			}
+			reportError(v.base, file, OperationError, fmt.Sprintf("error querying delegations for %s: %v", file, err), err)
+			return OperationError
+		}
+	} else if v == releasing {
+		received = nil
+	}
+
 	// Check if file is already owned by user.
 	stated, err := lstat(file)
 	if err != nil {
@@ -36,58 +244,246 @@ func _takeOwnership(file string, table GrantTable, myuid UID, simulate bool, fil
 			return Success
 		}
 		if !IsPermission(err) {
-			fmt.Fprintf(os.Stderr, "error taking ownership of %s: %v\n", file, err)
+			reportError(v.base, file, OperationError, fmt.Sprintf("error %s %s: %v", v.gerund, what, err), err)
 			return OperationError
 		}
 	} else {
-		if UID(stated.Uid) == myuid {
+		if UID(stated.Uid) == to && (v != releasing || delegation != nil && delegation.Release) {
 			trace("  _takeownership UID already match")
 			// No need to do anything.  Return.
-			if verbose {
-				fmt.Printf("file %s already owned\n", file)
+			if opts.tally == nil {
+				message := fmt.Sprintf("file %s already owned", file)
+				if to != myuid {
+					message = fmt.Sprintf("file %s already owned by %s", file, uidToUserOrStringifiedUid(to))
+				}
+				report(Result{Action: v.base, Path: file, Status: Success, Message: message}, opts.Verbose)
+			}
+			return Success
+		}
+		if v == releasing && UID(stated.Uid) != myuid {
+			// Only files the user owns can be released.
+			trace("  _takeownership file not owned by user")
+			if opts.tally == nil && fileVisibleToUser {
+				report(Result{Action: v.base, Path: file, Status: Success, Message: fmt.Sprintf("file %s not owned, skipping", file)}, opts.Verbose)
 			}
 			return Success
 		}
 	}
 
-	if !uids.Has(myuid) && !canAdminChownFile(file) {
+	authorized := false
+	switch v {
+	case taking:
+		authorized = delegation != nil
+	case giving:
+		authorized = delegation != nil && delegation.Dispatch
+	case releasing:
+		authorized = delegation != nil && delegation.Release
+	}
+	isAdmin := false
+	if !authorized && v != releasing {
+		isAdmin = callerCanChown
+	}
+	if !authorized && !isAdmin {
 		// Unauthorized.
 		trace("  _takeownership not allowed")
 		if !fileVisibleToUser {
 			return Success
 		}
-		fmt.Fprintf(os.Stderr, "error taking ownership of %s: %v\n", file, syscall.EACCES)
+		if !opts.Simulate {
+			auditChange(v, file, stated, to, nil, false, syscall.EACCES)
+		}
+		reportError(v.base, file, PermissionDenied, fmt.Sprintf("error %s %s: %v", v.gerund, what, syscall.EACCES), syscall.EACCES)
 		return PermissionDenied
 	}
+	if v == giving && received == nil && !isAdmin {
+		// Files may only be given to users who could take them.
+		trace("  _takeownership target not delegated")
+		if !fileVisibleToUser {
+			return Success
+		}
+		if !opts.Simulate {
+			auditChange(v, file, stated, to, delegation, false, targetNotDelegated)
+		}
+		reportError(v.base, file, PermissionDenied, fmt.Sprintf("error %s %s: %v", v.gerund, what, targetNotDelegated), targetNotDelegated)
+		return PermissionDenied
+	}
+	if authorized && v != releasing && len(delegation.Owners) > 0 && !delegation.Owners.Has(UID(stated.Uid)) {
+		// The delegation only covers files owned by certain users.
+		trace("  _takeownership current owner %d not allowed", stated.Uid)
+		if !fileVisibleToUser {
+			return Success
+		}
+		if !opts.Simulate {
+			auditChange(v, file, stated, to, delegation, false, ownerNotAllowed(UID(stated.Uid)))
+		}
+		reportError(v.base, file, PermissionDenied, fmt.Sprintf("error %s %s: %v", v.gerund, what, ownerNotAllowed(UID(stated.Uid))), ownerNotAllowed(UID(stated.Uid)))
+		return PermissionDenied
+	}
+	if authorized && v == giving && len(received.Owners) > 0 && !received.Owners.Has(UID(stated.Uid)) {
+		// Nor may files be given to users whose delegation would not let
+		// them take the files themselves.
+		trace("  _takeownership current owner %d not allowed for target", stated.Uid)
+		if !fileVisibleToUser {
+			return Success
+		}
+		err := targetOwnerNotAllowed(UID(stated.Uid))
+		if !opts.Simulate {
+			auditChange(v, file, stated, to, delegation, false, err)
+		}
+		reportError(v.base, file, PermissionDenied, fmt.Sprintf("error %s %s: %v", v.gerund, what, err), err)
+		return PermissionDenied
+	}
+
+	// Authorized.  Compute the mode and the ACLs the file will end up with.
+	var policy *ModePolicy
+	aclPolicy := ACLKeep
+	if received != nil {
+		policy = received.Mode
+		aclPolicy = received.ACL
+	}
+	mode, chmod := policy.Apply(stated.Mode, stated.Dir, opts.Mask)
+	if stated.Link {
+		chmod = false
+		aclPolicy = ACLKeep
+	}
+	trace("  _takeownership mode policy %s, mode %s, chmod %t, ACL policy %s", policy, mode, chmod, aclPolicy)
+	planned := stated
+	planned.Mode = mode
+	aclchange, err := aclPolicy.Plan(file, planned, UID(stated.Uid), to)
+	if err != nil {
+		if !fileVisibleToUser {
+			return Success
+		}
+		reportError(v.base, file, OperationError, fmt.Sprintf("error %s %s: %v", v.gerund, what, err), err)
+		return OperationError
+	}
+	changes := ""
+	if chmod {
+		changes = changes + fmt.Sprintf(" and set mode %s", mode)
+	}
+	if aclchange.changed() {
+		changes = changes + fmt.Sprintf(" and %s", aclPolicy)
+	}
+
+	// Changes the administrator could make anyway are not held to the
+	// limits of any delegation.
+	limited := delegation
+	if !authorized {
+		limited = nil
+	}
+	// Files given away count against the limits of the delegation of the
+	// receiving user too, as if the user took them.  Its being good for one
+	// change only concerns the user's own changes, though.
+	var receivedLimits *Delegation
+	if authorized && v == giving && received.Limits != nil {
+		r := *received
+		r.Once = false
+		receivedLimits = &r
+	}
+	if u := opts.unmeasured; u != nil && u.mustMeasure(file, stated, opts, limited, receivedLimits) {
+		trace("  _takeownership change must be totalled first")
+		u.stopped = true
+		return Success
+	}
+	if opts.tally != nil {
+		opts.tally.add(file, stated, limited, receivedLimits)
+		return Success
+	}
 
-	// Authorized.
-	if simulate {
+	if opts.Simulate {
 		if fileVisibleToUser {
-			fmt.Printf("would take ownership of %s\n", file)
+			report(Result{Action: v.base, Path: file, Status: Success, Message: fmt.Sprintf("would %s %s%s", v.base, what, changes)}, true)
 		}
 		return Success
 	}
 
-	err = os.Lchown(string(file), int(myuid), int(stated.Gid))
+	// A one-shot delegation is used up before the change is made, so no
+	// other run can use it as well, and put back should the change fail.
+	consumed := false
+	if limited != nil && limited.Once {
+		ok, err := table.Consume(limited)
+		if err == nil && !ok {
+			err = delegationUsedUp
+		}
+		if err != nil {
+			trace("  _takeownership cannot use one-shot delegation: %v", err)
+			status := OperationError
+			if err == delegationUsedUp {
+				status = PermissionDenied
+			}
+			auditChange(v, file, stated, to, limited, false, err)
+			if !fileVisibleToUser {
+				return Success
+			}
+			reportError(v.base, file, status, fmt.Sprintf("error %s %s: %v", v.gerund, what, err), err)
+			return status
+		}
+		consumed = true
+	}
+
+	// The ACLs and the mode are changed before the owner, so the new owner
+	// never gets a file with the permissions it had before.  Should any of
+	// the changes fail, the ones already made are undone.
+	undo := func() {
+		if consumed {
+			if rerr := table.Restore(limited); rerr != nil {
+				trace("  _takeownership error restoring one-shot delegation: %v", rerr)
+			}
+		}
+		if chmod {
+			if rerr := lchmod(file, stated.Mode); rerr != nil {
+				trace("  _takeownership error restoring mode: %v", rerr)
+			}
+		}
+		if aclchange.changed() {
+			if rerr := aclchange.revert(); rerr != nil {
+				trace("  _takeownership error restoring ACLs: %v", rerr)
+			}
+		}
+	}
+	if aclchange.changed() {
+		err = aclchange.apply()
+	}
+	if err == nil && chmod {
+		err = lchmod(file, mode)
+	}
 	if err != nil {
+		undo()
+		auditChange(v, file, stated, to, limited, !authorized, err)
 		if !fileVisibleToUser {
 			return Success
 		}
-		fmt.Fprintf(os.Stderr, "error taking ownership of %s: %v\n", file, err)
+		reportError(v.base, file, OperationError, fmt.Sprintf("error %s %s: %v", v.gerund, what, err), err)
 		return OperationError
 	}
 
-	if verbose {
-		fmt.Printf("took ownership of %s\n", file)
+	err = os.Lchown(string(file), int(to), int(stated.Gid))
+	if err != nil {
+		undo()
+		auditChange(v, file, stated, to, limited, !authorized, err)
+		if !fileVisibleToUser {
+			return Success
+		}
+		reportError(v.base, file, OperationError, fmt.Sprintf("error %s %s: %v", v.gerund, what, err), err)
+		return OperationError
 	}
+	auditChange(v, file, stated, to, limited, !authorized, nil)
+	if consumed {
+		audit(AuditEvent{Action: auditConsume, Path: file, Delegation: newAuditDelegation(limited), Result: auditResult(nil)})
+	}
+	if opts.done != nil {
+		opts.done.add(file, stated, limited, receivedLimits)
+	}
+
+	report(Result{Action: v.base, Path: file, Status: Success, Message: fmt.Sprintf("%s %s%s", v.past, what, changes)}, opts.Verbose)
 	return Success
 }
 
 func statAsUserIsPermitted(path string) bool {
-	dropToCallingUserTemporarily()
-	defer returnToRoot()
-
-	_, err := lstat(path)
+	err := asCallingUser(func() error {
+		_, err := lstat(path)
+		return err
+	})
 	trace("  statAsUserIsPermitted %s = %v", path, err)
 
 	if err == nil {
@@ -96,17 +492,149 @@ func statAsUserIsPermitted(path string) bool {
 	return false
 }
 
-func takeOwnership(paths []string, recursive bool, simulate bool, verbose bool) (retval int) {
-	trace("recursive %v, simulate %v, pathnames passed: %q", recursive, simulate, paths)
-	table := NewUNIXGrantTable()
-	myuid := UID(os.Getuid())
+// listAsUserIsPermitted returns true if the calling user could read the
+// directory on their own.
+func listAsUserIsPermitted(path string) bool {
+	err := asCallingUser(func() error {
+		f, err := os.Open(path)
+		if err == nil {
+			f.Close()
+		}
+		return err
+	})
+	trace("  listAsUserIsPermitted %s = %v", path, err)
+	return err == nil
+}
+
+// checkQuota refuses transfers that would take the receiving user past
+// the hard limits of their disk quota, and warns about those that would
+// take them past the soft limits.
+func checkQuota(t *tally, opts takeOptions) (retval int) {
+	if opts.Release || opts.IgnoreQuota {
+		return Success
+	}
+	name := uidToUserOrStringifiedUid(opts.To)
+	for _, dev := range t.devices {
+		tr := t.transfers[dev]
+		quota, err := GetQuota(tr.Path, opts.To)
+		if err != nil {
+			reportError("quota", tr.Path, OperationError, fmt.Sprintf("error checking disk quota of %s: %v", name, err), err)
+			return OperationError
+		}
+		trace("  quota of %d on file system of %s: %+v, transfer %s", opts.To, tr.Path, quota, tr)
+		hard, soft := quota.Check(tr)
+		if hard {
+			err := fmt.Errorf("transferring %s would exceed the disk quota of %s on the file system of %s", tr, name, tr.Path)
+			reportError("quota", tr.Path, OperationError, "error: "+err.Error(), err)
+			return OperationError
+		}
+		if soft {
+			report(Result{Action: "quota", Path: tr.Path, Status: Success, Warning: true, Message: fmt.Sprintf("warning: transferring %s will exceed the soft disk quota of %s on the file system of %s", tr, name, tr.Path)}, true)
+		}
+	}
+	return Success
+}
 
+func files(n uint64) string {
+	if n == 1 {
+		return "1 file"
+	}
+	return fmt.Sprintf("%d files", n)
+}
+
+// checkLimits refuses changes that would exceed the limits of the
+// delegations authorizing them.  If any of the delegations has a daily
+// limit, the usage file is returned, locked so no other run can use up the
+// same allowance before this one records what it did.
+func checkLimits(t *tally, v verb) (*UsageLog, int) {
+	var usage *UsageLog
+	for _, d := range t.delegations {
+		used := t.limited[usageKey(*d)]
+		exceeded := func(err error) (*UsageLog, int) {
+			reportError("limit", d.Path, PermissionDenied, "error: "+err.Error(), err)
+			return usage, PermissionDenied
+		}
+		prefix := fmt.Sprintf("%s ownership of %s under the delegation on %s would exceed its limit of", v.gerund, files(used.Inodes), d.Path)
+		if d.Once && used.Inodes > 1 {
+			return exceeded(fmt.Errorf("%s 1 file, as it may only be used once", prefix))
+		}
+		if d.Limits == nil {
+			continue
+		}
+		if d.Limits.Files != 0 && used.Inodes > d.Limits.Files {
+			return exceeded(fmt.Errorf("%s %s per run", prefix, files(d.Limits.Files)))
+		}
+		if d.Limits.Bytes != 0 && used.Bytes > d.Limits.Bytes {
+			return exceeded(fmt.Errorf("%s ownership of %d bytes under the delegation on %s would exceed its limit of %d bytes per run", v.gerund, used.Bytes, d.Path, d.Limits.Bytes))
+		}
+		if d.Limits.DailyFiles == 0 {
+			continue
+		}
+		if usage == nil {
+			var err error
+			if usage, err = OpenUsage(); err != nil {
+				reportError("limit", d.Path, OperationError, fmt.Sprintf("error checking delegation limits: %v", err), err)
+				return nil, OperationError
+			}
+		}
+		today := usage.Today(*d)
+		trace("  delegation on %s used for %d files today, limit %d", d.Path, today, d.Limits.DailyFiles)
+		if today+used.Inodes > d.Limits.DailyFiles {
+			return exceeded(fmt.Errorf("%s %s per day (%d already used today)", prefix, files(d.Limits.DailyFiles), today))
+		}
+	}
+	return usage, Success
+}
+
+// walk runs _takeOwnership on every path and, if recursive, on everything
+// under each path.  If quiet, errors are not reported.  Paths handled
+// already are skipped.  Should a change need totalling first, the walk
+// stops.
+func walk(paths []string, table GrantTable, myuid UID, opts takeOptions, quiet bool) (retval int) {
 	retval = Success
+	take := func(path string, reveal bool) int {
+		if r, ok := opts.handled[path]; ok {
+			return r
+		}
+		r := _takeOwnership(path, table, myuid, opts, reveal)
+		if u := opts.unmeasured; u != nil && !u.stopped {
+			u.handled[path] = r
+		}
+		return r
+	}
+	stopped := func() bool {
+		return opts.unmeasured != nil && opts.unmeasured.stopped
+	}
 	for _, file := range paths {
-		if recursive {
+		if stopped() {
+			break
+		}
+		if opts.Recursive {
 			fn := func(path string, dentry os.DirEntry, err error) error {
-				revealError := statAsUserIsPermitted(path)
-				r := _takeOwnership(path, table, myuid, simulate, revealError || path == file, verbose)
+				if err != nil && dentry != nil {
+					// The directory was handled already, but could
+					// not be read.  Without privileges to read it
+					// regardless, that is only news to users who
+					// could read it.  Should it have been handled
+					// before the run started over, so was this.
+					if _, ok := opts.handled[path]; !ok && !quiet && listAsUserIsPermitted(path) {
+						status := OperationError
+						if IsPermission(err) {
+							status = PermissionDenied
+						}
+						reportError("read", path, status, fmt.Sprintf("error reading directory %s: %v", path, err), err)
+						retval = status | retval
+					}
+					return nil
+				}
+				reveal := false
+				if !quiet {
+					reveal = path == file || statAsUserIsPermitted(path)
+				}
+				r := take(path, reveal)
+				if stopped() {
+					return errMustMeasure
+				}
 				if r != Success {
 					trace("  _takeownership unsuccessful: %d", r)
 					retval = r | retval
@@ -122,7 +650,70 @@ func takeOwnership(paths []string, recursive bool, simulate bool, verbose bool)
 			}
 			filepath.WalkDir(file, fn)
 		} else {
-			retval = _takeOwnership(file, table, myuid, simulate, true, verbose) | retval
+			retval = take(file, !quiet) | retval
+		}
+	}
+	return
+}
+
+func takeOwnership(paths []string, opts takeOptions) (retval int) {
+	trace("recursive %v, simulate %v, pathnames passed: %q", opts.Recursive, opts.Simulate, paths)
+	table := NewUNIXGrantTable()
+	myuid := UID(os.Getuid())
+
+	v := taking
+	if opts.Release {
+		v = releasing
+	} else if opts.To != myuid {
+		v = giving
+	}
+
+	// Most runs change files under delegations without limits, for users
+	// without disk quotas, so files are changed right away, until a change
+	// that must be totalled first is met.  The run then starts over,
+	// skipping the paths handled already.
+	if !opts.Simulate {
+		first := opts
+		first.unmeasured = &unmeasured{quotas: map[uint64]bool{}, handled: map[string]int{}}
+		retval = walk(paths, table, myuid, first, false)
+		if !first.unmeasured.stopped {
+			return
+		}
+		opts.handled = first.unmeasured.handled
+	}
+
+	// Total what would change hands first, so the limits of the
+	// delegations and the quota of the receiving user are checked before
+	// any other change is made.
+	measure := opts
+	measure.Verbose = false
+	measure.tally = newTally()
+	walk(paths, table, myuid, measure, true)
+	usage, r := checkLimits(measure.tally, v)
+	if usage != nil {
+		defer usage.Close()
+	}
+	if r != Success {
+		return retval | r
+	}
+	if r := checkQuota(measure.tally, opts); r != Success {
+		return retval | r
+	}
+
+	if opts.Simulate {
+		retval = walk(paths, table, myuid, opts, false)
+		report(Result{Action: "transfer", Status: Success, Message: fmt.Sprintf("would transfer %s", measure.tally.total())}, true)
+		return
+	}
+	opts.done = newTally()
+	retval = walk(paths, table, myuid, opts, false) | retval
+	for _, d := range opts.done.delegations {
+		if d.Limits == nil || d.Limits.DailyFiles == 0 || usage == nil {
+			continue
+		}
+		if err := usage.Record(*d, opts.done.limited[usageKey(*d)].Inodes); err != nil {
+			reportError("limit", d.Path, OperationError, fmt.Sprintf("error recording use of delegation on %s: %v", d.Path, err), err)
+			retval = retval | OperationError
 		}
 	}
 	return
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// completionOption is an option as shells complete it.
+type completionOption struct {
+	// names are the spellings of the option, dashes included.
+	names []string
+	// arg names the argument of the option, or is empty if it takes none.
+	arg  string
+	help string
+}
+
+// commandOptions returns the options of the subcommand.
+func commandOptions(c *command) []completionOption {
+	result := []completionOption{}
+	for _, opt := range c.options {
+		names := []string{}
+		if opt.short != "" {
+			names = append(names, "-"+opt.short)
+		}
+		names = append(names, "--"+opt.long)
+		result = append(result, completionOption{names, opt.arg, opt.help})
+	}
+	return append(result, completionOption{[]string{"-h", "--help"}, "", "show this help"})
+}
+
+// legacyOptions returns the flags of the original interface.
+func legacyOptions() []completionOption {
+	result := []completionOption{}
+	for _, f := range legacyFlags {
+		if !f.hidden {
+			result = append(result, completionOption{[]string{"-" + f.name}, f.arg, f.help})
+		}
+	}
+	return result
+}
+
+// argumentWords returns the fixed words an argument may take, if any.
+func argumentWords(arg string) []string {
+	switch arg {
+	case "FORMAT":
+		return []string{string(FormatText), string(FormatJSON), string(FormatNUL)}
+	case "POLICY":
+		return []string{string(ACLStrip), string(ACLRewrite), string(ACLInherit)}
+	case "SHELL":
+		return []string{"bash", "zsh", "fish"}
+	}
+	return nil
+}
+
+func takingArgument(opts []completionOption) []string {
+	result := []string{}
+	for _, opt := range opts {
+		if opt.arg != "" {
+			result = append(result, opt.names...)
+		}
+	}
+	return result
+}
+
+func allNames(opts []completionOption) []string {
+	result := []string{}
+	for _, opt := range opts {
+		result = append(result, opt.names...)
+	}
+	return result
+}
+
+// argumentsByKind groups the names of options by the kind of argument they
+// take.
+func argumentsByKind(opts []completionOption, args ...string) []string {
+	result := []string{}
+	for _, opt := range opts {
+		for _, arg := range args {
+			if opt.arg == arg {
+				result = append(result, opt.names...)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+const bashCompletion = `# bash completion for takeown
+_takeown_delegates() {
+    local -a paths=("${COMP_WORDS[@]:COMP_CWORD+1}")
+    COMPREPLY=($(compgen -W "$(takeown -completion-delegates -- "${paths[@]}" 2>/dev/null)" -- "$cur"))
+}
+
+_takeown() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+    local cmd=legacy opts argopts first=1 i positional=0 user=""
+    case "${COMP_WORDS[1]}" in
+%[1]s
+    esac
+    case "$prev" in
+        %[2]s) COMPREPLY=($(compgen -u -- "$cur")); return ;;
+        %[3]s) COMPREPLY=($(compgen -f -- "$cur")); return ;;
+        %[4]s) COMPREPLY=($(compgen -W "%[5]s" -- "$cur")); return ;;
+        %[6]s) COMPREPLY=($(compgen -W "%[7]s" -- "$cur")); return ;;
+        %[8]s) COMPREPLY=($(compgen -W "%[9]s" -- "$cur")); return ;;
+    esac
+    if [[ " $argopts " == *" $prev "* ]]; then
+        return
+    fi
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "$opts" -- "$cur"))
+        return
+    fi
+    for ((i = first; i < COMP_CWORD; i++)); do
+        local w="${COMP_WORDS[i]}"
+        case "$w" in
+            -a) user=grant ;;
+            -d) user=revoke ;;
+        esac
+        if [[ " $argopts " == *" $w "* ]]; then
+            ((i++))
+        elif [[ "$w" != -* ]]; then
+            ((positional++))
+        fi
+    done
+    case "$cmd" in
+        grant|revoke) user=$cmd ;;
+        help) COMPREPLY=($(compgen -W "%[10]s" -- "$cur")); return ;;
+    esac
+    if [[ $positional -eq 0 && "$user" == grant ]]; then
+        COMPREPLY=($(compgen -u -- "$cur"))
+    elif [[ $positional -eq 0 && "$user" == revoke ]]; then
+        _takeown_delegates
+    elif [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "%[10]s" -- "$cur") $(compgen -f -- "$cur"))
+    else
+        COMPREPLY=($(compgen -f -- "$cur"))
+    fi
+}
+complete -o filenames -F _takeown takeown
+`
+
+func bashScript() string {
+	cases := []string{}
+	all := []completionOption{}
+	for _, name := range commandNames {
+		opts := commandOptions(findCommand(name))
+		all = append(all, opts...)
+		cases = append(cases, fmt.Sprintf("        %s) cmd=%s first=2 opts=%q argopts=%q ;;", name, name, strings.Join(allNames(opts), " "), strings.Join(takingArgument(opts), " ")))
+	}
+	legacy := legacyOptions()
+	all = append(all, legacy...)
+	cases = append(cases, fmt.Sprintf("        *) opts=%q argopts=%q ;;", strings.Join(allNames(legacy), " "), strings.Join(takingArgument(legacy), " ")))
+	alternatives := func(args ...string) string {
+		names := dedup(argumentsByKind(all, args...))
+		if len(names) == 0 {
+			return "--never--"
+		}
+		return strings.Join(names, "|")
+	}
+	return fmt.Sprintf(bashCompletion,
+		strings.Join(cases, "\n"),
+		alternatives("USER", "USERS"),
+		alternatives("FILE", "PATH", "MANIFEST"),
+		alternatives("FORMAT"), strings.Join(argumentWords("FORMAT"), " "),
+		alternatives("POLICY"), strings.Join(argumentWords("POLICY"), " "),
+		alternatives("SHELL"), strings.Join(argumentWords("SHELL"), " "),
+		strings.Join(commandNames, " "),
+	)
+}
+
+func dedup(s []string) []string {
+	result := []string{}
+	for n, x := range s {
+		if n > 0 && s[n-1] == x {
+			continue
+		}
+		result = append(result, x)
+	}
+	return result
+}
+
+// zshEscape escapes text for the descriptions of _arguments specs.
+func zshEscape(s string) string {
+	r := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`)
+	return r.Replace(s)
+}
+
+func zshAction(arg string) string {
+	switch arg {
+	case "USER":
+		return "_users"
+	case "USERS":
+		return "_sequence _users"
+	case "FILE", "PATH", "MANIFEST":
+		return "_files"
+	}
+	if words := argumentWords(arg); words != nil {
+		return "(" + strings.Join(words, " ") + ")"
+	}
+	return " "
+}
+
+func zshSpecs(opts []completionOption) string {
+	specs := []string{}
+	for _, opt := range opts {
+		help := zshEscape(opt.help)
+		for _, name := range opt.names {
+			spec := name
+			if opt.arg != "" {
+				if strings.HasPrefix(name, "--") {
+					spec = spec + "="
+				} else {
+					spec = spec + "+"
+				}
+			}
+			spec = fmt.Sprintf("'%s[%s]", spec, help)
+			if opt.arg != "" {
+				spec = spec + fmt.Sprintf(":%s:%s", strings.ToLower(opt.arg), zshAction(opt.arg))
+			}
+			specs = append(specs, spec+"'")
+		}
+	}
+	return strings.Join(specs, " \\\n                ")
+}
+
+const zshCompletion = `#compdef takeown
+
+_takeown_delegates() {
+    local -a users
+    users=(${(f)"$(takeown -completion-delegates -- ${words[CURRENT+1,-1]} 2>/dev/null)"})
+    _describe -t users 'user holding a delegation' users
+}
+
+_takeown() {
+    local -a commands
+    commands=(
+%[1]s
+    )
+    if (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then
+        _describe -t commands command commands
+        _files
+        return
+    fi
+    local cmd=$words[2]
+    if (( ${+commands[(r)$cmd:*]} )); then
+        shift words
+        (( CURRENT-- ))
+    fi
+    case $cmd in
+%[2]s
+        *)
+            local user='*:path:_files'
+            if (( ${words[(I)-a]} )); then
+                user='1:user:_users'
+            elif (( ${words[(I)-d]} )); then
+                user='1:user:_takeown_delegates'
+            fi
+            _arguments -S \
+                %[3]s \
+                "$user" '*:path:_files'
+            ;;
+    esac
+}
+
+_takeown "$@"
+`
+
+func zshScript() string {
+	descriptions := []string{}
+	cases := []string{}
+	for _, name := range commandNames {
+		c := findCommand(name)
+		descriptions = append(descriptions, fmt.Sprintf("        '%s:%s'", name, zshEscape(c.brief)))
+		positional := "'*:path:_files'"
+		switch name {
+		case "grant":
+			positional = "'1:user:_users' '*:path:_files'"
+		case "revoke":
+			positional = "'1:user:_takeown_delegates' '*:path:_files'"
+		case "help":
+			positional = "'1:command:(" + strings.Join(commandNames, " ") + ")'"
+		}
+		cases = append(cases, fmt.Sprintf("        %s)\n            _arguments -S \\\n                %s \\\n                %s\n            ;;", name, zshSpecs(commandOptions(c)), positional))
+	}
+	return fmt.Sprintf(zshCompletion, strings.Join(descriptions, "\n"), strings.Join(cases, "\n"), zshSpecs(legacyOptions()))
+}
+
+const fishCompletion = `# fish completion for takeown
+function __takeown_positional
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    if contains -- "$tokens[1]" %[1]s
+        set -e tokens[1]
+    end
+    set -l n 0
+    set -l skip 0
+    for t in $tokens
+        if test $skip -eq 1
+            set skip 0
+        else if contains -- $t %[2]s
+            set skip 1
+        else if not string match -q -- '-*' $t
+            set n (math $n + 1)
+        end
+    end
+    echo $n
+end
+
+function __takeown_delegates
+    set -l all (commandline -o)
+    set -l before (commandline -opc)
+    takeown -completion-delegates -- $all[(math (count $before) + 2)..-1] 2>/dev/null
+end
+
+complete -c takeown -f
+complete -c takeown -n 'test (count (commandline -opc)) -eq 1' -F
+%[3]s
+`
+
+func fishSpec(condition string, opt completionOption) string {
+	s := fmt.Sprintf("complete -c takeown -n '%s'", condition)
+	for _, name := range opt.names {
+		switch {
+		case strings.HasPrefix(name, "--"):
+			s = s + " -l " + name[2:]
+		case len(name) == 2:
+			s = s + " -s " + name[1:]
+		default:
+			s = s + " -o " + name[1:]
+		}
+	}
+	if opt.arg != "" {
+		s = s + " -r"
+		switch opt.arg {
+		case "USER", "USERS":
+			s = s + " -a '(__fish_complete_users)'"
+		case "FILE", "PATH", "MANIFEST":
+			s = s + " -F"
+		default:
+			if words := argumentWords(opt.arg); words != nil {
+				s = s + fmt.Sprintf(" -a '%s'", strings.Join(words, " "))
+			}
+		}
+	}
+	return s + fmt.Sprintf(" -d '%s'", strings.ReplaceAll(opt.help, "'", `\'`))
+}
+
+func fishScript() string {
+	lines := []string{}
+	noCommand := "not __fish_seen_subcommand_from " + strings.Join(commandNames, " ")
+	argopts := []string{}
+	for _, name := range commandNames {
+		c := findCommand(name)
+		lines = append(lines, fmt.Sprintf("complete -c takeown -n 'test (count (commandline -opc)) -eq 1' -a %s -d '%s'", name, c.brief))
+		cond := "__fish_seen_subcommand_from " + name
+		opts := commandOptions(c)
+		argopts = append(argopts, takingArgument(opts)...)
+		for _, opt := range opts {
+			lines = append(lines, fishSpec(cond, opt))
+		}
+		switch name {
+		case "grant":
+			lines = append(lines, fmt.Sprintf("complete -c takeown -n '%s; and test (__takeown_positional) -eq 0' -a '(__fish_complete_users)'", cond))
+			lines = append(lines, fmt.Sprintf("complete -c takeown -n '%s; and test (__takeown_positional) -gt 0' -F", cond))
+		case "revoke":
+			lines = append(lines, fmt.Sprintf("complete -c takeown -n '%s; and test (__takeown_positional) -eq 0' -a '(__takeown_delegates)'", cond))
+			lines = append(lines, fmt.Sprintf("complete -c takeown -n '%s; and test (__takeown_positional) -gt 0' -F", cond))
+		case "help":
+			lines = append(lines, fmt.Sprintf("complete -c takeown -n '%s' -a '%s'", cond, strings.Join(commandNames, " ")))
+		default:
+			lines = append(lines, fmt.Sprintf("complete -c takeown -n '%s' -F", cond))
+		}
+	}
+	legacy := legacyOptions()
+	argopts = append(argopts, takingArgument(legacy)...)
+	for _, opt := range legacy {
+		lines = append(lines, fishSpec(noCommand, opt))
+	}
+	lines = append(lines,
+		fmt.Sprintf("complete -c takeown -n '%s; and __fish_contains_opt -s a; and test (__takeown_positional) -eq 0' -a '(__fish_complete_users)'", noCommand),
+		fmt.Sprintf("complete -c takeown -n '%s; and __fish_contains_opt -s d; and test (__takeown_positional) -eq 0' -a '(__takeown_delegates)'", noCommand),
+		fmt.Sprintf("complete -c takeown -n '%s; and not __fish_contains_opt -s a -s d; or test (__takeown_positional) -gt 0' -F", noCommand),
+	)
+	sort.Strings(argopts)
+	return fmt.Sprintf(fishCompletion, strings.Join(commandNames, " "), strings.Join(dedup(argopts), " "), strings.Join(lines, "\n"))
+}
+
+// completionScript returns the completion script for the shell.
+func completionScript(shell string) (string, error) {
+	switch shell {
+	case "bash":
+		return bashScript(), nil
+	case "zsh":
+		return zshScript(), nil
+	case "fish":
+		return fishScript(), nil
+	}
+	return "", fmt.Errorf("no completion for shell %q (valid shells are bash, zsh and fish)", shell)
+}
+
+// completeDelegates prints the names of the users holding delegations
+// established on the paths, or on the current directory, so completion
+// scripts can offer them when revoking delegations.  Errors are ignored.
+func completeDelegates(paths []string) int {
+	if err := dropToCallingUser(); err != nil {
+		return OperationError
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	table := NewUNIXGrantTable()
+	names := []string{}
+	seen := make(map[UID]bool)
+	for _, path := range paths {
+		real, err := realpath(path)
+		if err != nil {
+			continue
+		}
+		stated, err := lstat(real)
+		if err != nil {
+			continue
+		}
+		delegations, err := table.Established(real, !stated.Dir)
+		if err != nil {
+			continue
+		}
+		for _, d := range delegations {
+			if !seen[d.UID] {
+				seen[d.UID] = true
+				names = append(names, string(uidToUserOrStringifiedUid(d.UID)))
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stdout, name)
+	}
+	return Success
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Grant is a delegation to a single user, along with the policies that
+// apply when that user takes ownership under it.  A grant that carries no
+// policies is stored as a bare UID, which is what older versions of takeown
+// wrote to the grants attribute.
+type Grant struct {
+	UID  UID         `json:"uid"`
+	Mode *ModePolicy `json:"mode,omitempty"`
+	ACL  ACLPolicy   `json:"acl,omitempty"`
+	// Dispatch lets the user give ownership away to other users who hold
+	// a delegation covering the file.
+	Dispatch bool `json:"dispatch,omitempty"`
+	// Release lets the user hand files back, either to Home or, if unset,
+	// to the owner of the directory that carries the grant.
+	Release bool `json:"release,omitempty"`
+	Home    *UID `json:"home,omitempty"`
+	// Owners, when set, restricts the files the user may take ownership
+	// of to those currently owned by these users.
+	Owners UIDRanges `json:"owners,omitempty"`
+	// Include and Exclude, when set, restrict the files the grant covers
+	// to those matching the glob patterns, relative to the directory that
+	// carries the grant.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// Limits, when set, cap how many files the user may take ownership of
+	// under the grant.
+	Limits *Limits `json:"limits,omitempty"`
+	// Manage lets the user add and revoke delegations that do not carry
+	// Manage themselves, on the paths the grant covers.
+	Manage bool `json:"manage,omitempty"`
+	// Once makes the grant good for a single change of ownership, after
+	// which it is removed.
+	Once bool `json:"once,omitempty"`
+	// Windows, when set, restrict the times at which the grant may be
+	// used to those within any of the windows, in the time zone named by
+	// Timezone, or in the local time of the system if it is unset.
+	Windows  []TimeWindow `json:"windows,omitempty"`
+	Timezone string       `json:"timezone,omitempty"`
+}
+
+// grantRecord is Grant without its JSON methods, to avoid recursing into
+// them while marshaling.
+type grantRecord Grant
+
+// plain returns true if the grant carries nothing but the UID.
+func (g Grant) plain() bool {
+	return g.Mode == nil && g.ACL == ACLKeep && !g.Dispatch && !g.Release && g.Home == nil && len(g.Owners) == 0 && len(g.Include) == 0 && len(g.Exclude) == 0 && g.Limits == nil && !g.Manage && !g.Once && len(g.Windows) == 0 && g.Timezone == ""
+}
+
+func (g Grant) MarshalJSON() ([]byte, error) {
+	if g.plain() {
+		return json.Marshal(g.UID)
+	}
+	return json.Marshal(grantRecord(g))
+}
+
+func (g *Grant) UnmarshalJSON(data []byte) error {
+	var uid UID
+	if err := json.Unmarshal(data, &uid); err == nil {
+		*g = Grant{UID: uid}
+		return nil
+	}
+	var r grantRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	*g = Grant(r)
+	return nil
+}
+
+// Covers decides whether the grant covers a path relative to the directory
+// carrying it, according to the include and exclude patterns of the grant.
+// It also returns the reason for the decision.
+func (g Grant) Covers(rel string) (bool, string) {
+	for _, pattern := range g.Exclude {
+		if matchPattern(pattern, rel) {
+			return false, fmt.Sprintf("excluded by pattern %s", pattern)
+		}
+	}
+	if len(g.Include) == 0 {
+		return true, "covered"
+	}
+	for _, pattern := range g.Include {
+		if matchPattern(pattern, rel) {
+			return true, fmt.Sprintf("included by pattern %s", pattern)
+		}
+	}
+	return false, "not included by any pattern"
+}
+
+// Applies decides whether the grant covers a path relative to the directory
+// carrying it at the time passed, according to both its patterns and its
+// time windows.  It also returns the reason for the decision.
+func (g Grant) Applies(rel string, now time.Time) (bool, string) {
+	covers, reason := g.Covers(rel)
+	if !covers || len(g.Windows) == 0 {
+		return covers, reason
+	}
+	loc := time.Local
+	if g.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(g.Timezone); err != nil {
+			return false, fmt.Sprintf("%s, but time zone %s is unknown", reason, g.Timezone)
+		}
+	}
+	now = now.In(loc)
+	for _, w := range g.Windows {
+		if w.Contains(now) {
+			return true, fmt.Sprintf("%s, within window %s", reason, w)
+		}
+	}
+	return false, fmt.Sprintf("%s, but outside window %s (now %s)", reason, g.windows(), now.Format("Mon 15:04 MST"))
+}
+
+// windows describes the time windows of the grant, along with their time
+// zone.
+func (g Grant) windows() string {
+	s := []string{}
+	for _, w := range g.Windows {
+		s = append(s, w.String())
+	}
+	if g.Timezone != "" {
+		return strings.Join(s, ", ") + " " + g.Timezone
+	}
+	return strings.Join(s, ", ")
+}
+
+// String describes the policies of the grant.
+func (g Grant) String() string {
+	s := []string{}
+	if len(g.Include) > 0 {
+		s = append(s, "include "+strings.Join(g.Include, " "))
+	}
+	if len(g.Exclude) > 0 {
+		s = append(s, "exclude "+strings.Join(g.Exclude, " "))
+	}
+	if len(g.Owners) > 0 {
+		s = append(s, "owners "+g.Owners.String())
+	}
+	if len(g.Windows) > 0 {
+		s = append(s, "window "+g.windows())
+	}
+	if g.Limits != nil {
+		s = append(s, "limit "+g.Limits.String())
+	}
+	if g.Mode != nil {
+		s = append(s, "mode "+g.Mode.String())
+	}
+	if g.ACL != ACLKeep {
+		s = append(s, "acl "+string(g.ACL))
+	}
+	if g.Dispatch {
+		s = append(s, "dispatch")
+	}
+	if g.Manage {
+		s = append(s, "manage")
+	}
+	if g.Once {
+		s = append(s, "once")
+	}
+	if g.Home != nil {
+		s = append(s, "release to "+string(uidToUserOrStringifiedUid(*g.Home)))
+	} else if g.Release {
+		s = append(s, "release")
+	}
+	return strings.Join(s, "; ")
+}
+
+// Equal returns true if both grants are for the same user and carry the
+// same policies.
+func (g Grant) Equal(o Grant) bool {
+	a, _ := json.Marshal(g)
+	b, _ := json.Marshal(o)
+	return string(a) == string(b)
+}
+
+type GrantList []Grant
+
+// UIDs returns the list of users that hold a grant in this list.
+func (l GrantList) UIDs() UIDList {
+	result := UIDList{}
+	for _, g := range l {
+		result = append(result, g.UID)
+	}
+	return result
+}
+
+// Find returns the grant for the specified user, or nil if the user holds
+// no grant in this list.
+func (l GrantList) Find(uid UID) *Grant {
+	for n := range l {
+		if l[n].UID == uid {
+			return &l[n]
+		}
+	}
+	return nil
+}
+
+// Set returns a new list where the grant for g's user has been replaced by
+// g, or where g has been appended if the user held no grant.
+func (l GrantList) Set(g Grant) GrantList {
+	result := GrantList{}
+	replaced := false
+	for _, x := range l {
+		if x.UID == g.UID {
+			if !replaced {
+				result = append(result, g)
+				replaced = true
+			}
+			continue
+		}
+		result = append(result, x)
+	}
+	if !replaced {
+		result = append(result, g)
+	}
+	return result
+}
+
+// Remove returns a list with the grants of all users in u removed.
+func (l GrantList) Remove(u UIDList) GrantList {
+	result := GrantList{}
+	for _, x := range l {
+		if u.Has(x.UID) {
+			continue
+		}
+		result = append(result, x)
+	}
+	return result
+}
+
+// Equal returns true if both GrantLists are equal.
+func (a GrantList) Equal(b GrantList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if !a[n].Equal(b[n]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Delegation is a grant as found on a specific path.  The path is that of
+// a directory, unless File is set.
+type Delegation struct {
+	Path string
+	File bool
+	Grant
+}
+
+// String describes the delegation the way takeown -l lists it.
+func (d Delegation) String() string {
+	s := d.Path
+	if d.File {
+		s = "file " + s
+	}
+	if d.Grant.plain() {
+		return s
+	}
+	return fmt.Sprintf("%s (%s)", s, d.Grant)
+}
+
+// ReleaseTarget returns the user that files released under the delegation
+// are handed back to.  Files delegated individually go back to the owner
+// of the directory containing them.
+func (d *Delegation) ReleaseTarget() (UID, error) {
+	if d.Home != nil {
+		return *d.Home, nil
+	}
+	dir := d.Path
+	if d.File {
+		dir = filepath.Dir(dir)
+	}
+	stated, err := lstat(dir)
+	if err != nil {
+		return 0, NewError("stat", dir, err)
+	}
+	return UID(stated.Uid), nil
+}
@@ -1,22 +1,41 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
-	"syscall"
+	"time"
+
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
 )
 
 const ATTRNAME = "security.takeown.grants"
 
+// GRANTLOCK is locked while grants are read and written back, so that
+// concurrent runs of takeown do not undo each other's changes.
+var GRANTLOCK = statePath("/var/lib/takeown/grants.lock")
+
+var patternsOnFile = errors.New("grants on files cannot carry path patterns")
+var grantsOnLink = errors.New("symbolic links cannot carry grants")
+
 type GrantTable interface {
-	ForDir(string) (UIDList, error)
-	ForPath(string) (UIDList, error)
-	Add(string, UID) error
+	Lookup(string, UID) (*Delegation, error)
+	Add(*grantTarget, Grant) error
+	Consume(*Delegation) (bool, error)
+	Restore(*Delegation) error
 }
 
+// dirgrant holds the grants established on a path, which is a directory
+// unless file is set.  Its parent holds the grants established on the
+// directory containing the path.
 type dirgrant struct {
-	directory string
-	grants    UIDList
-	parent    *dirgrant
+	path   string
+	file   bool
+	grants GrantList
+	parent *dirgrant
 }
 
 type UNIXGrantTable struct {
@@ -34,8 +53,8 @@ func (t *UNIXGrantTable) getDirgrant(real string) (*dirgrant, error) {
 		return dg, nil
 	}
 	d := &dirgrant{}
-	d.directory = real
-	d.grants = UIDList{}
+	d.path = real
+	d.grants = GrantList{}
 	err := UnmarshalFromXattr(real, ATTRNAME, &d.grants)
 	if err != nil {
 		return nil, err
@@ -51,125 +70,387 @@ func (t *UNIXGrantTable) getDirgrant(real string) (*dirgrant, error) {
 	return d, nil
 }
 
-func (t *UNIXGrantTable) _for(path string, mustBeDir bool) (UIDList, error) {
+// resolve returns the real path of the file, along with the grants on the
+// path itself, which lead to the grants on the directories containing it.
+// Symbolic links carry no grants of their own, so for them the chain starts
+// at the directory containing the link.
+func (t *UNIXGrantTable) resolve(path string) (string, *dirgrant, error) {
 	fs, err := lstat(path)
 	if err != nil {
-		return nil, NewError("stat", path, err)
+		return "", nil, NewError("stat", path, err)
 	}
-	if !fs.Dir {
-		if mustBeDir {
-			return nil, NewError("stat", path, syscall.Errno(syscall.ENOTDIR))
+	if fs.Dir {
+		real, err := realpath(path)
+		if err != nil {
+			return "", nil, err
 		}
-		path = filepath.Dir(path)
+		dirgrant, err := t.getDirgrant(real)
+		return real, dirgrant, err
 	}
-	real, err := realpath(path)
+	dir, err := realpath(filepath.Dir(path))
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	}
+	real := filepath.Join(dir, filepath.Base(path))
+	if fs.Link {
+		dirgrant, err := t.getDirgrant(dir)
+		return real, dirgrant, err
 	}
 	dirgrant, err := t.getDirgrant(real)
+	if err != nil {
+		return "", nil, err
+	}
+	dirgrant.file = true
+	return real, dirgrant, nil
+}
+
+// relative returns the slash-separated path of real within directory.
+func relative(directory string, real string) string {
+	rel, err := filepath.Rel(directory, real)
+	if err != nil {
+		return real
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Table returns the delegations that each user holds on the path and on the
+// directories leading to it, whether they cover the path or not.
+func (t *UNIXGrantTable) Table(path string) (map[UID][]Delegation, error) {
+	_, dirgrant, err := t.resolve(path)
 	if err != nil {
 		return nil, err
 	}
-	result := UIDList{}
+	result := make(map[UID][]Delegation)
 	for dirgrant != nil {
-		result = result.Merge(dirgrant.grants)
+		for _, g := range dirgrant.grants {
+			result[g.UID] = append(result[g.UID], Delegation{dirgrant.path, dirgrant.file, g})
+		}
 		dirgrant = dirgrant.parent
 	}
 	return result, nil
 }
 
-func (t *UNIXGrantTable) Table(path string) (map[UID][]string, error) {
-	mustBeDir := false
-	fs, err := lstat(path)
+// Explanation tells whether a delegation covers a path, and why.
+type Explanation struct {
+	Delegation
+	Covers bool
+	Reason string
+}
+
+// Explain returns, for each delegation established on the path and on the
+// directories leading to it, whether it covers the path, nearest first.
+func (t *UNIXGrantTable) Explain(path string) ([]Explanation, error) {
+	real, dirgrant, err := t.resolve(path)
 	if err != nil {
-		return nil, NewError("stat", path, err)
+		return nil, err
 	}
-	if !fs.Dir {
-		if mustBeDir {
-			return nil, NewError("stat", path, syscall.Errno(syscall.ENOTDIR))
+	now := time.Now()
+	result := []Explanation{}
+	for dirgrant != nil {
+		for _, g := range dirgrant.grants {
+			covers, reason := g.Applies(relative(dirgrant.path, real), now)
+			result = append(result, Explanation{Delegation{dirgrant.path, dirgrant.file, g}, covers, reason})
 		}
-		path = filepath.Dir(path)
+		dirgrant = dirgrant.parent
 	}
-	real, err := realpath(path)
+	return result, nil
+}
+
+// Lookup returns the delegation that authorizes the user to take ownership
+// of the path.  The nearest grant that covers the path wins, so grants on
+// the file itself come first, and the policies established closest to the
+// path are the ones that apply.  Grants with time windows only cover the
+// path within them.  If the user holds no grant covering the path, it
+// returns nil.
+func (t *UNIXGrantTable) Lookup(path string, uid UID) (*Delegation, error) {
+	real, dirgrant, err := t.resolve(path)
 	if err != nil {
 		return nil, err
 	}
-	result := make(map[UID][]string)
-	dirgrant, err := t.getDirgrant(real)
+	now := time.Now()
+	for dirgrant != nil {
+		if g := dirgrant.grants.Find(uid); g != nil {
+			if covers, _ := g.Applies(relative(dirgrant.path, real), now); covers {
+				return &Delegation{dirgrant.path, dirgrant.file, *g}, nil
+			}
+		}
+		dirgrant = dirgrant.parent
+	}
+	return nil, nil
+}
+
+// grantTarget is a path whose delegations are to change.  It is resolved
+// and opened once, with the credentials of the calling user, and then handed
+// to checkManager and to Add or Remove, which read and write the grants on
+// it through the descriptor, so that what is checked is what is written
+// even if the path, or a directory leading to it, is swapped for a symbolic
+// link in between.  It must be closed once done with.
+type grantTarget struct {
+	path string
+	real string
+	fd   int
+	fs   sinfo
+}
+
+// openGrantTarget resolves and opens the path whose delegations are to
+// change.  The calling user must be able to reach the path, so that users
+// learn nothing about paths they cannot see.  Like the original grant
+// command, it refuses symbolic links instead of changing the delegations on
+// what they lead to, although the directories leading to the path may be
+// symbolic links.
+func openGrantTarget(path string) (*grantTarget, error) {
+	target := &grantTarget{path: path, fd: -1}
+	err := asCallingUser(func() error {
+		fs, err := lstat(path)
+		if err != nil {
+			return NewError("stat", path, err)
+		}
+		if fs.Link {
+			return NewError("change grants", path, grantsOnLink)
+		}
+		if target.real, err = realpath(path); err != nil {
+			return err
+		}
+		// The real path has no symbolic links in it, so should any
+		// directory leading to it be swapped for one since, opening it
+		// fails instead of reaching another file.
+		target.fd, err = unix.Openat2(unix.AT_FDCWD, target.real, &unix.OpenHow{
+			Flags:   unix.O_PATH | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+			Resolve: unix.RESOLVE_NO_SYMLINKS,
+		})
+		if err != nil {
+			return NewError("open", path, err)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	if target.fs, err = fstat(target.fd); err != nil {
+		target.Close()
+		return nil, NewError("stat", path, err)
+	}
+	if target.fs.Link {
+		target.Close()
+		return nil, NewError("change grants", path, grantsOnLink)
+	}
+	return target, nil
+}
+
+func (target *grantTarget) Close() error {
+	return unix.Close(target.fd)
+}
+
+// attrPath names the file through its descriptor.  Descriptors opened with
+// O_PATH cannot be passed to fgetxattr() and fsetxattr(), but the kernel
+// lets us reach the file they refer to through /proc.
+func (target *grantTarget) attrPath() string {
+	return fmt.Sprintf("/proc/self/fd/%d", target.fd)
+}
+
+// named makes errors about the attributes of the file name its real path,
+// rather than the descriptor they were reached through.
+func (target *grantTarget) named(err error) error {
+	var xerr *xattr.Error
+	if errors.As(err, &xerr) {
+		xerr.Path = target.real
+	}
+	return err
+}
+
+// attr returns the grants attribute of the file as it is, or nil if it has
+// none.
+func (target *grantTarget) attr() (*[]byte, error) {
+	data, err := getxattr(target.attrPath(), ATTRNAME)
+	return data, target.named(err)
+}
+
+// setAttr sets the grants attribute of the file, or removes it if data is
+// nil.
+func (target *grantTarget) setAttr(data *[]byte) error {
+	if data == nil {
+		err := xattr.Remove(target.attrPath(), ATTRNAME)
+		if err != nil && isNoData(err) {
+			return nil
+		}
+		return target.named(err)
+	}
+	return target.named(setxattr(target.attrPath(), ATTRNAME, *data))
+}
+
+// Grants returns the grants established on the file.
+func (target *grantTarget) Grants() (GrantList, error) {
+	u := GrantList{}
+	attr, err := target.attr()
+	if err != nil || attr == nil {
+		return u, err
+	}
+	if err := json.Unmarshal(*attr, &u); err != nil {
+		return nil, NewError("unmarshal", target.real, err)
+	}
+	return u, nil
+}
+
+// SetGrants replaces the grants established on the file.
+func (target *grantTarget) SetGrants(u GrantList) error {
+	data, err := json.Marshal(&u)
+	if err != nil {
+		return NewError("marshal", target.real, err)
+	}
+	return target.setAttr(&data)
+}
+
+// Manager returns the delegation that lets the user manage delegations on
+// the path, or nil if the user holds none.  The path must be a real path,
+// such as that of a grantTarget.
+func (t *UNIXGrantTable) Manager(real string, uid UID) (*Delegation, error) {
+	_, dirgrant, err := t.resolve(real)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
 	for dirgrant != nil {
-		for _, uid := range dirgrant.grants {
-			existing, ok := result[uid]
-			if !ok {
-				existing = []string{}
+		if g := dirgrant.grants.Find(uid); g != nil && g.Manage {
+			if covers, _ := g.Applies(relative(dirgrant.path, real), now); covers {
+				return &Delegation{dirgrant.path, dirgrant.file, *g}, nil
 			}
-			result[uid] = append(existing, dirgrant.directory)
 		}
 		dirgrant = dirgrant.parent
 	}
-	return result, nil
-}
-
-func (t *UNIXGrantTable) ForDir(path string) (UIDList, error) {
-	return t._for(path, true)
+	return nil, nil
 }
 
-func (t *UNIXGrantTable) ForPath(path string) (UIDList, error) {
-	return t._for(path, false)
+// Held returns the grant the user holds on the target itself, or nil if the
+// user holds none there.
+func (t *UNIXGrantTable) Held(target *grantTarget, uid UID) (*Grant, error) {
+	u, err := target.Grants()
+	if err != nil {
+		return nil, err
+	}
+	return u.Find(uid), nil
 }
 
-func (t *UNIXGrantTable) Add(path string, uid UID) error {
-	fs, err := lstat(path)
+// Add establishes the grant on the target, replacing any grant that the
+// same user already held on it.  The target may be a directory, in which
+// case the grant covers the files within it, or a file, in which case the
+// grant only covers the file.  The grants on the target are read and
+// written back with GRANTLOCK held, so that grants added or removed at the
+// same time by other runs of takeown are not lost.
+func (t *UNIXGrantTable) Add(target *grantTarget, g Grant) error {
+	if !target.fs.Dir && (len(g.Include) > 0 || len(g.Exclude) > 0) {
+		return NewError("add grant", target.real, patternsOnFile)
+	}
+	lock, err := lockGrants()
 	if err != nil {
-		return NewError("stat", path, err)
+		return err
+	}
+	defer lock.Close()
+	u, err := target.Grants()
+	if err != nil {
+		return err
+	}
+	u2 := u.Set(g)
+	if u.Equal(u2) {
+		return nil
 	}
-	if !fs.Dir {
-		return NewError("stat", path, syscall.Errno(syscall.ENOTDIR))
+	if err := target.SetGrants(u2); err != nil {
+		return err
 	}
-	real, err := realpath(path)
+	delete(t.directories, target.real)
+	return nil
+}
+
+// Remove revokes the grant the user holds on the target, if any, holding
+// GRANTLOCK as Add does.
+func (t *UNIXGrantTable) Remove(target *grantTarget, uid UID) error {
+	lock, err := lockGrants()
 	if err != nil {
 		return err
 	}
-	u := UIDList{}
-	if err := UnmarshalFromXattr(real, ATTRNAME, &u); err != nil {
+	defer lock.Close()
+	u, err := target.Grants()
+	if err != nil {
 		return err
 	}
-	u2 := u.Merge(UIDList{uid})
+	u2 := u.Remove(UIDList{uid})
 	if u.Equal(u2) {
 		return nil
 	}
-	if err := MarshalToXattr(real, ATTRNAME, &u2); err != nil {
+	if err := target.SetGrants(u2); err != nil {
 		return err
 	}
-	delete(t.directories, real)
+	delete(t.directories, target.real)
 	return nil
 }
 
-func (t *UNIXGrantTable) Remove(path string, uid UID) error {
-	fs, err := lstat(path)
+// lockGrants locks GRANTLOCK, creating it if need be.  Closing the file
+// releases the lock.
+func lockGrants() (*os.File, error) {
+	return openStateFile(GRANTLOCK, 0600)
+}
+
+// Consume removes the one-shot grant of the delegation, so it cannot be
+// used again.  It returns false if the grant is gone or has changed since
+// the delegation was looked up, which happens when another run of takeown
+// used it first.
+func (t *UNIXGrantTable) Consume(d *Delegation) (bool, error) {
+	lock, err := lockGrants()
 	if err != nil {
-		return NewError("stat", path, err)
+		return false, err
+	}
+	defer lock.Close()
+	u := GrantList{}
+	if err := UnmarshalFromXattr(d.Path, ATTRNAME, &u); err != nil {
+		return false, err
+	}
+	if g := u.Find(d.UID); g == nil || !g.Equal(d.Grant) {
+		return false, nil
 	}
-	if !fs.Dir {
-		return NewError("stat", path, syscall.Errno(syscall.ENOTDIR))
+	u2 := u.Remove(UIDList{d.UID})
+	if err := LMarshalToXattr(d.Path, ATTRNAME, &u2); err != nil {
+		return false, err
 	}
-	real, err := realpath(path)
+	// The grants cached for the paths under the delegation lead to the
+	// ones consumed, so none of them can be used any longer.
+	t.directories = make(map[string]*dirgrant)
+	return true, nil
+}
+
+// Restore puts back the one-shot grant of the delegation, consumed for a
+// change that could not be made after all.  A grant established for the
+// same user in the meantime is kept instead.
+func (t *UNIXGrantTable) Restore(d *Delegation) error {
+	lock, err := lockGrants()
 	if err != nil {
 		return err
 	}
-	u := UIDList{}
-	if err := UnmarshalFromXattr(real, ATTRNAME, &u); err != nil {
+	defer lock.Close()
+	u := GrantList{}
+	if err := UnmarshalFromXattr(d.Path, ATTRNAME, &u); err != nil {
 		return err
 	}
-	u2 := u.Remove(UIDList{uid})
-	if u.Equal(u2) {
+	if u.Find(d.UID) != nil {
 		return nil
 	}
-	if err := MarshalToXattr(real, ATTRNAME, &u2); err != nil {
+	u2 := u.Set(d.Grant)
+	if err := LMarshalToXattr(d.Path, ATTRNAME, &u2); err != nil {
 		return err
 	}
-	delete(t.directories, real)
+	t.directories = make(map[string]*dirgrant)
 	return nil
 }
+
+// Established returns the delegations established on the path itself, as
+// opposed to those inherited from the directories containing it.  The path
+// must be a real path, and not a symbolic link.
+func (t *UNIXGrantTable) Established(real string, file bool) ([]Delegation, error) {
+	u := GrantList{}
+	if err := UnmarshalFromXattr(real, ATTRNAME, &u); err != nil {
+		return nil, err
+	}
+	result := []Delegation{}
+	for _, g := range u {
+		result = append(result, Delegation{real, file, g})
+	}
+	return result, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The caller of takeown chooses the environment, descriptors, umask, limits
+// and working directory it starts with.  Before doing anything else, takeown
+// puts them in a known state, or refuses to run if it cannot.
+
+// safePath is the only PATH takeown runs with.
+const safePath = "/usr/sbin:/usr/bin:/sbin:/bin"
+
+// safeEnvironment lists the environment variables kept from the caller.
+// The C library and name service modules ignore the rest, or must be kept
+// from seeing them.
+var safeEnvironment = []string{"LANG", "LANGUAGE", "LC_ALL", "LC_COLLATE", "LC_CTYPE", "LC_MESSAGES", "LC_NUMERIC", "LC_TIME", "TERM", "TZ"}
+
+// safeUmask is the umask takeown creates its own files with.
+const safeUmask = 022
+
+// resourceLimit is the least a limit must allow for takeown to finish what
+// it starts.  A file size limit, for instance, could cut the usage file short.
+type resourceLimit struct {
+	resource int
+	name     string
+	least    uint64
+}
+
+var resourceLimits = []resourceLimit{
+	{unix.RLIMIT_FSIZE, "file size", unix.RLIM_INFINITY},
+	{unix.RLIMIT_NOFILE, "open files", 64},
+	{unix.RLIMIT_STACK, "stack size", 1 << 20},
+	{unix.RLIMIT_DATA, "data size", 1 << 30},
+	{unix.RLIMIT_AS, "address space", 1 << 30},
+}
+
+// sanitizeProcess puts the state takeown inherits in order.  It must run
+// first thing in main.
+func sanitizeProcess() error {
+	for fd := 0; fd <= 2; fd++ {
+		if standardDescriptorClosed(fd) {
+			return fmt.Errorf("standard input, output and error must be open")
+		}
+	}
+	if err := closeDescriptors(); err != nil {
+		return fmt.Errorf("cannot close inherited descriptors: %v", err)
+	}
+
+	env := []string{"PATH=" + safePath}
+	for _, name := range safeEnvironment {
+		if value, ok := os.LookupEnv(name); ok && safeEnvironmentValue(value) {
+			env = append(env, name+"="+value)
+		}
+	}
+	os.Clearenv()
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		if err := os.Setenv(kv[:i], kv[i+1:]); err != nil {
+			return fmt.Errorf("cannot set environment: %v", err)
+		}
+	}
+
+	unix.Umask(safeUmask)
+
+	for _, l := range resourceLimits {
+		if err := checkResourceLimit(l); err != nil {
+			return err
+		}
+	}
+
+	// Relative paths are resolved against the working directory, which
+	// must therefore be reachable from the root directory.
+	if _, err := unix.Getwd(); err != nil {
+		return fmt.Errorf("cannot determine the working directory: %v", err)
+	}
+	return nil
+}
+
+// standardDescriptorClosed returns true if the caller left the descriptor
+// closed, so that the files takeown opens could take its place.  Recent Go
+// runtimes open /dev/null in place of closed standard descriptors before
+// main runs, which is as safe, and cannot be told apart from callers
+// redirecting them to /dev/null themselves, so only descriptors that are
+// still closed count.
+func standardDescriptorClosed(fd int) bool {
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	return err == unix.EBADF
+}
+
+// safeEnvironmentValue refuses values that would make the C library or Go
+// read files of the caller's choosing, such as TZ=/path/to/file.
+func safeEnvironmentValue(value string) bool {
+	if strings.HasPrefix(value, "/") || strings.HasPrefix(value, ":/") || strings.Contains(value, "..") {
+		return false
+	}
+	return !strings.ContainsAny(value, "\n\x00")
+}
+
+// closeDescriptors closes every descriptor above standard error that was
+// inherited.  Those are the ones without close-on-exec, which exec would
+// have closed; the descriptors opened since, by packages initialized before
+// main or by the runtime for polling, all have it, and must stay open.
+func closeDescriptors() error {
+	fds := []int{}
+	dir, err := unix.Open("/proc/self/fd", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err == nil {
+		defer unix.Close(dir)
+		buf := make([]byte, 4096)
+		for {
+			n, err := unix.Getdents(dir, buf)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			_, _, names := unix.ParseDirent(buf[:n], -1, nil)
+			for _, name := range names {
+				if fd, err := strconv.Atoi(name); err == nil {
+					fds = append(fds, fd)
+				}
+			}
+		}
+	} else {
+		// Without /proc, try every descriptor the limit allows.
+		var lim unix.Rlimit
+		if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+			return err
+		}
+		if lim.Cur > 1<<16 {
+			lim.Cur = 1 << 16
+		}
+		for fd := 0; fd < int(lim.Cur); fd++ {
+			fds = append(fds, fd)
+		}
+	}
+	for _, fd := range fds {
+		if fd <= 2 {
+			continue
+		}
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		if err != nil || flags&unix.FD_CLOEXEC != 0 {
+			continue
+		}
+		trace("closing inherited descriptor %d", fd)
+		unix.Close(fd)
+	}
+	return nil
+}
+
+// checkResourceLimit raises the soft limit up to the hard limit if it is
+// lower than takeown needs, and fails if the hard limit is lower too.
+func checkResourceLimit(l resourceLimit) error {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(l.resource, &lim); err != nil {
+		return fmt.Errorf("cannot read the %s limit: %v", l.name, err)
+	}
+	if lim.Cur >= l.least {
+		return nil
+	}
+	if lim.Max < l.least {
+		return fmt.Errorf("the %s limit is %d, but takeown needs %s", l.name, lim.Max, limitString(l.least))
+	}
+	trace("raising %s limit from %d to %d", l.name, lim.Cur, lim.Max)
+	lim.Cur = lim.Max
+	if err := unix.Setrlimit(l.resource, &lim); err != nil {
+		return fmt.Errorf("cannot raise the %s limit: %v", l.name, err)
+	}
+	return nil
+}
+
+func limitString(n uint64) string {
+	if n == unix.RLIM_INFINITY {
+		return "unlimited"
+	}
+	return fmt.Sprintf("at least %d", n)
+}
+
+// checkNotTraced refuses to run a privileged takeown under a debugger,
+// which could change what it does.  The kernel usually keeps a tracer from
+// attaching to a privileged process, but not one that has CAP_SYS_PTRACE.
+func checkNotTraced() error {
+	if installation != installedSetuid && installation != installedCapabilities {
+		return nil
+	}
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return fmt.Errorf("cannot tell whether takeown is being traced: %v", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if value := strings.TrimPrefix(s.Text(), "TracerPid:"); value != s.Text() {
+			if strings.TrimSpace(value) != "0" {
+				return fmt.Errorf("takeown must not run while being traced")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot tell whether takeown is being traced: %v", s.Err())
+}
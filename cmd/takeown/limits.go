@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USAGEFILE records how many files each delegation with a daily limit has
+// been used on, per day.
+var USAGEFILE = statePath("/var/lib/takeown/usage.json")
+
+// Limits cap the volume of files a user may take ownership of under a
+// delegation.  Zero means no limit.
+type Limits struct {
+	// Files and Bytes limit every single run of takeown.
+	Files uint64 `json:"files,omitempty"`
+	Bytes uint64 `json:"bytes,omitempty"`
+	// DailyFiles limits all runs of takeown within a day.
+	DailyFiles uint64 `json:"daily_files,omitempty"`
+}
+
+// NewLimits returns limits out of the numbers passed as strings.  Empty
+// strings leave the respective limit unset.  Byte counts may carry a K, M,
+// G or T suffix.  If all strings are empty, it returns nil.
+func NewLimits(files string, bytes string, dailyFiles string) (*Limits, error) {
+	l := &Limits{}
+	var err error
+	if files != "" {
+		if l.Files, err = strconv.ParseUint(files, 10, 64); err != nil || l.Files == 0 {
+			return nil, fmt.Errorf("invalid file limit %q", files)
+		}
+	}
+	if bytes != "" {
+		if l.Bytes, err = parseBytes(bytes); err != nil || l.Bytes == 0 {
+			return nil, fmt.Errorf("invalid byte limit %q", bytes)
+		}
+	}
+	if dailyFiles != "" {
+		if l.DailyFiles, err = strconv.ParseUint(dailyFiles, 10, 64); err != nil || l.DailyFiles == 0 {
+			return nil, fmt.Errorf("invalid daily file limit %q", dailyFiles)
+		}
+	}
+	if *l == (Limits{}) {
+		return nil, nil
+	}
+	return l, nil
+}
+
+func parseBytes(s string) (uint64, error) {
+	multiplier := uint64(1)
+	for n, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(strings.ToUpper(s), suffix) {
+			multiplier = 1 << (10 * uint(n+1))
+			s = s[:len(s)-1]
+			break
+		}
+	}
+	b, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return b * multiplier, nil
+}
+
+func (l *Limits) String() string {
+	s := []string{}
+	if l.Files != 0 {
+		s = append(s, fmt.Sprintf("%d files per run", l.Files))
+	}
+	if l.Bytes != 0 {
+		s = append(s, fmt.Sprintf("%d bytes per run", l.Bytes))
+	}
+	if l.DailyFiles != 0 {
+		s = append(s, fmt.Sprintf("%d files per day", l.DailyFiles))
+	}
+	return strings.Join(s, ", ")
+}
+
+// usageKey identifies a delegation in the usage file.
+func usageKey(d Delegation) string {
+	return fmt.Sprintf("%d:%s", d.UID, d.Path)
+}
+
+type usageRecord struct {
+	Day   string `json:"day"`
+	Files uint64 `json:"files"`
+}
+
+// UsageLog is the usage file, locked for as long as it stays open.
+type UsageLog struct {
+	f       *os.File
+	day     string
+	records map[string]usageRecord
+}
+
+// OpenUsage opens and locks the usage file, creating it if need be.  It
+// refuses to use a file that anyone but the administrator could modify.
+func OpenUsage() (*UsageLog, error) {
+	f, err := openStateFile(USAGEFILE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	u := &UsageLog{f, time.Now().Format("2006-01-02"), make(map[string]usageRecord)}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		u.Close()
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &u.records); err != nil {
+			u.Close()
+			return nil, NewError("unmarshal", USAGEFILE, err)
+		}
+	}
+	return u, nil
+}
+
+// Today returns how many files were taken today under the delegation.
+func (u *UsageLog) Today(d Delegation) uint64 {
+	r, ok := u.records[usageKey(d)]
+	if !ok || r.Day != u.day {
+		return 0
+	}
+	return r.Files
+}
+
+// Record adds files taken under the delegation to today's count, and saves
+// the usage file.  Records from past days are dropped.
+func (u *UsageLog) Record(d Delegation, files uint64) error {
+	for key, r := range u.records {
+		if r.Day != u.day {
+			delete(u.records, key)
+		}
+	}
+	u.records[usageKey(d)] = usageRecord{u.day, u.Today(d) + files}
+	data, err := json.Marshal(u.records)
+	if err != nil {
+		return NewError("marshal", USAGEFILE, err)
+	}
+	if err := u.f.Truncate(0); err != nil {
+		return NewError("write", USAGEFILE, err)
+	}
+	if _, err := u.f.WriteAt(data, 0); err != nil {
+		return NewError("write", USAGEFILE, err)
+	}
+	return nil
+}
+
+// Close releases the lock on the usage file.
+func (u *UsageLog) Close() error {
+	return u.f.Close()
+}
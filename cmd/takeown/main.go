@@ -8,74 +8,331 @@ import (
 
 const (
 	Success          = 0
+	Drift            = 1
 	BadConfig        = 8
 	OperationError   = 32
 	Usage            = 64
 	PermissionDenied = 128
 )
 
-var addFlag = flag.Bool("a", false, "add a delegation for a specific user and path")
-var listFlag = flag.Bool("l", false, "list user delegations established on paths")
-var deleteFlag = flag.Bool("d", false, "remove a delegation for a specific user and path")
-var recurseFlag = flag.Bool("r", false, "take ownership recursively")
-var verboseFlag = flag.Bool("v", false, "when taking ownership, print out the actions taken")
-var simulateFlag = flag.Bool("s", false, "simulate taking ownership")
-var traceFlag = flag.Bool("T", false, "show trace of internal execution; requires file `/.trace` to exist")
+// The original interface selects what to do with single-letter flags, and
+// takes the remaining options from the same flag set.  It is still accepted
+// whenever the first argument is not a subcommand.
+var addFlag, listFlag, deleteFlag, explainFlag bool
+var helpFlag, manFlag bool
+var completionFlag string
 
-func usage() {
-	fmt.Fprintf(os.Stderr, USAGE)
+// The flags for requests for delegations select what to do, too.
+var requestFlag, approveFlag, rejectFlag string
+var pendingFlag, requestsFlag bool
+
+// The flags for manifests select what to do, too.
+var applyFlag string
+var checkFlag bool
+
+// completionDelegatesFlag is for the completion scripts, which run it to
+// learn which users may be revoked from the paths being completed.
+var completionDelegatesFlag bool
+
+var legacy = options{format: string(FormatText)}
+
+// legacyFlag describes a flag of the original interface.  Value points to
+// the variable the flag sets: a *bool, a *string or a flag.Value.
+type legacyFlag struct {
+	name  string
+	arg   string
+	help  string
+	value interface{}
+	// hidden flags are left out of the help, the manual and completion.
+	hidden bool
 }
 
-func main() {
-	flag.Parse()
+var legacyFlags = []legacyFlag{
+	{"a", "", "add a delegation for a specific user and path", &addFlag, false},
+	{"d", "", "remove a delegation for a specific user and path", &deleteFlag, false},
+	{"l", "", "list user delegations established on paths", &listFlag, false},
+	{"explain", "", "explain which delegations cover paths, and why", &explainFlag, false},
+	{"request", "PATH", "request a delegation on a path from the administrator", &requestFlag, false},
+	{"pending", "", "list the pending requests for delegations you may approve or reject", &pendingFlag, false},
+	{"approve", "ID", "approve a request for a delegation, establishing it", &approveFlag, false},
+	{"reject", "ID", "reject a request for a delegation", &rejectFlag, false},
+	{"requests", "", "list your requests for delegations, and what became of them", &requestsFlag, false},
+	{"r", "", "take ownership recursively", &legacy.recursive, false},
+	{"s", "", "simulate taking ownership", &legacy.simulate, false},
+	{"v", "", "when taking ownership, print out the actions taken", &legacy.verbose, false},
+	{"m", "MODE", "when taking ownership, restrict the mode of files to at most these bits", &legacy.mode, false},
+	{"to", "USER", "give ownership to this user instead of taking it; requires a dispatch delegation", &legacy.to, false},
+	{"release", "", "hand files you own back to the user designated by their delegation", &legacy.release, false},
+	{"ignore-quota", "", "when taking ownership, do not check disk quotas; only for the administrator", &legacy.ignoreQuota, false},
+	{"apply", "MANIFEST", "establish the delegations declared in a manifest, and revoke the others on the paths it lists, all or nothing", &applyFlag, false},
+	{"check", "", "with -apply, only show how the delegations differ from the manifest, exiting with status 1 if they do", &checkFlag, false},
+	{"reason", "TEXT", "with -request, why you need the delegation", &legacy.reason, false},
+	{"include", "PATTERN", "with -a, only cover files matching this pattern; may be repeated", &legacy.include, false},
+	{"exclude", "PATTERN", "with -a, do not cover files matching this pattern; may be repeated", &legacy.exclude, false},
+	{"owners", "USERS", "with -a, only let the user take files owned by these users or UID ranges", &legacy.owners, false},
+	{"max-files", "N", "with -a, let the user take at most this many files per run", &legacy.maxFiles, false},
+	{"max-bytes", "SIZE", "with -a, let the user take at most this many bytes per run; K, M, G and T suffixes are accepted", &legacy.maxBytes, false},
+	{"max-daily-files", "N", "with -a, let the user take at most this many files per day", &legacy.maxDailyFiles, false},
+	{"window", "WINDOW", "with -a, only let the user take files within this time window, such as Mon-Fri 22:00-06:00; may be repeated", &legacy.windows, false},
+	{"timezone", "ZONE", "with -window, the time zone of the windows, such as Europe/Berlin; the local time by default", &legacy.timezone, false},
+	{"dispatch", "", "with -a, let the user give ownership away to other delegated users", &legacy.dispatch, false},
+	{"manage", "", "with -a, let the user add and revoke delegations under the path; only for the administrator", &legacy.manage, false},
+	{"once", "", "with -a, let the user take ownership only once, after which the delegation is removed", &legacy.once, false},
+	{"allow-release", "", "with -a, let the user hand files back to the owner of the directory", &legacy.allowRelease, false},
+	{"home", "USER", "with -a, let the user hand files back to this user instead; implies -allow-release", &legacy.home, false},
+	{"file-mode", "MODE", "with -a, set this mode on files whose ownership is taken", &legacy.fileMode, false},
+	{"dir-mode", "MODE", "with -a, set this mode on directories whose ownership is taken", &legacy.dirMode, false},
+	{"umask", "MODE", "with -a, remove these mode bits from files whose ownership is taken", &legacy.umask, false},
+	{"acl", "POLICY", "with -a, policy for POSIX ACLs of files whose ownership is taken: strip, rewrite or inherit", &legacy.acl, false},
+	{"format", "FORMAT", "report results as text, json, or nul for NUL-separated fields", &legacy.format, false},
+	{"files-from", "FILE", "also operate on the paths listed in this file, one per line; - reads them from standard input", &legacy.filesFrom, false},
+	{"0", "", "with -files-from, paths are terminated by NUL characters instead of newlines", &legacy.nul, false},
+	{"no-sandbox", "", "do not confine takeown to the paths it works on; only for the administrator", &legacy.noSandbox, false},
+	{"T", "", "show trace of internal execution; requires file /.trace to exist", &legacy.trace, false},
+	{"completion", "SHELL", "print the completion script for this shell: bash, zsh or fish", &completionFlag, false},
+	{"completion-delegates", "", "list the users holding delegations on paths, for shell completion", &completionDelegatesFlag, true},
+	{"man", "", "print the manual page of takeown, in troff format", &manFlag, false},
+	{"help", "", "show this help", &helpFlag, false},
+}
 
-	if *traceFlag {
-		if set := setTrace(); !set {
-			fmt.Fprintf(os.Stderr, "error: the file /.trace must exist to enable tracing\n")
-			os.Exit(PermissionDenied)
+// findLegacyFlag returns the flag of the original interface with the name.
+func findLegacyFlag(name string) *legacyFlag {
+	for n := range legacyFlags {
+		if legacyFlags[n].name == name {
+			return &legacyFlags[n]
 		}
 	}
+	return nil
+}
 
-	if *listFlag {
-		if *recurseFlag || *addFlag || *deleteFlag || *simulateFlag || *verboseFlag {
-			usage()
-			os.Exit(Usage)
-		}
-		paths := flag.Args()
-		if len(paths) == 0 {
-			paths = []string{"."}
+// commonFlags are accepted by every action that works on paths or requests,
+// pathFlags by those taking paths or IDs, and grantFlags, which set the
+// policies of a grant, by those establishing delegations.
+var commonFlags = []string{"T", "format", "no-sandbox"}
+var pathFlags = []string{"files-from", "0"}
+var grantFlags = []string{"include", "exclude", "owners", "max-files", "max-bytes", "max-daily-files", "window", "timezone", "dispatch", "manage", "once", "allow-release", "home", "file-mode", "dir-mode", "umask", "acl"}
+
+func flagNames(groups ...[]string) []string {
+	names := []string{}
+	for _, g := range groups {
+		names = append(names, g...)
+	}
+	return names
+}
+
+// legacyMode is an action of the original interface: the flag selecting it,
+// the other flags it accepts, and its arguments, none if args is empty.
+// Taking ownership is selected by no flag.
+type legacyMode struct {
+	flag  string
+	flags []string
+	args  string
+	// minArgs is the number of arguments the action requires, unless paths
+	// are read with -files-from, which may stand in for all but the first.
+	minArgs int
+}
+
+var legacyModes = []legacyMode{
+	{"", flagNames(commonFlags, []string{"r", "s", "v", "m", "to", "ignore-quota"}, pathFlags), "PATH...", 1},
+	{"release", flagNames(commonFlags, []string{"r", "s", "v", "m", "ignore-quota"}, pathFlags), "PATH...", 1},
+	{"a", flagNames(commonFlags, grantFlags, pathFlags), "USER PATH...", 2},
+	{"d", flagNames(commonFlags, pathFlags), "USER PATH...", 2},
+	{"l", flagNames(commonFlags, pathFlags), "[PATH]...", 0},
+	{"explain", flagNames(commonFlags, pathFlags), "[PATH]...", 0},
+	{"request", flagNames(commonFlags, []string{"reason"}, pathFlags), "[PATH]...", 0},
+	{"pending", commonFlags, "", 0},
+	{"approve", flagNames(commonFlags, grantFlags, pathFlags), "[ID]...", 0},
+	{"reject", flagNames(commonFlags, pathFlags), "[ID]...", 0},
+	{"requests", commonFlags, "", 0},
+	{"apply", flagNames(commonFlags, []string{"check"}), "", 0},
+	{"completion", nil, "", 0},
+	{"completion-delegates", nil, "[PATH]...", 0},
+	{"man", nil, "", 0},
+	{"help", nil, "", 0},
+}
+
+// accepts returns true if the flag may be set along with the action.
+func (m *legacyMode) accepts(name string) bool {
+	if name == m.flag {
+		return true
+	}
+	for _, f := range m.flags {
+		if f == name {
+			return true
 		}
-		os.Exit(listDelegations(paths))
 	}
+	return false
+}
 
-	if *addFlag {
-		if *recurseFlag || *listFlag || *deleteFlag || *simulateFlag || *verboseFlag {
-			usage()
-			os.Exit(Usage)
+// setFlags returns the names of the flags set on the command line.  Flags
+// set to nothing, or boolean flags set to false, count as not set.
+func setFlags() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); value == "" || ok && b.IsBoolFlag() && value == "false" {
+			return
 		}
-		if flag.NArg() < 2 {
-			usage()
-			os.Exit(Usage)
+		if f.Name == "h" {
+			set["help"] = true
+		} else {
+			set[f.Name] = true
 		}
-		os.Exit(addDelegation(flag.Args()[0], flag.Args()[1:]))
+	})
+	return set
+}
+
+// selectMode returns the action selected by the flags set, or nil if they
+// select several actions or one that does not accept them all.
+func selectMode(set map[string]bool) *legacyMode {
+	mode := &legacyModes[0]
+	for n := range legacyModes {
+		m := &legacyModes[n]
+		if m.flag == "" || !set[m.flag] {
+			continue
+		}
+		if mode.flag != "" {
+			return nil
+		}
+		mode = m
 	}
+	for name := range set {
+		if !mode.accepts(name) {
+			return nil
+		}
+	}
+	return mode
+}
 
-	if *deleteFlag {
-		if *recurseFlag || *addFlag || *listFlag || *simulateFlag || *verboseFlag {
-			usage()
-			os.Exit(Usage)
+func init() {
+	for _, f := range legacyFlags {
+		switch p := f.value.(type) {
+		case *bool:
+			flag.BoolVar(p, f.name, *p, f.help)
+		case *string:
+			flag.StringVar(p, f.name, *p, f.help)
+		case flag.Value:
+			flag.Var(p, f.name, f.help)
 		}
-		if flag.NArg() < 2 {
-			usage()
+	}
+	flag.BoolVar(&helpFlag, "h", false, "show this help")
+	flag.Usage = usage
+}
+
+func usage() {
+	writeHelp(os.Stderr)
+}
+
+func main() {
+	if err := sanitizeProcess(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(OperationError)
+	}
+	if err := checkInstallation(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(BadConfig)
+	}
+	if err := checkNotTraced(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(PermissionDenied)
+	}
+
+	if len(os.Args) > 1 {
+		if c := findCommand(os.Args[1]); c != nil {
+			os.Exit(c.main(os.Args[2:]))
+		}
+	}
+
+	flag.Parse()
+	mode := selectMode(setFlags())
+	if mode == nil || mode.args == "" && flag.NArg() > 0 {
+		usage()
+		os.Exit(Usage)
+	}
+	switch mode.flag {
+	case "help":
+		writeHelp(os.Stdout)
+		os.Exit(Success)
+	case "man":
+		writeManual(os.Stdout)
+		os.Exit(Success)
+	case "completion":
+		script, err := completionScript(completionFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(Usage)
 		}
-		os.Exit(deleteDelegation(flag.Args()[0], flag.Args()[1:]))
+		fmt.Print(script)
+		os.Exit(Success)
+	case "completion-delegates":
+		os.Exit(completeDelegates(flag.Args()))
 	}
 
-	if flag.NArg() < 1 {
+	o := &legacy
+	listed := o.setup()
+	required := mode.minArgs
+	if o.filesFrom != "" && required > 0 {
+		required--
+	}
+	if o.nul && o.filesFrom == "" || flag.NArg() < required {
 		usage()
 		os.Exit(Usage)
 	}
 
-	os.Exit(takeOwnership(flag.Args(), *recurseFlag, *simulateFlag, *verboseFlag))
+	switch mode.flag {
+	case "request":
+		if o.reason == "" {
+			fmt.Fprintf(os.Stderr, "error: -request needs a -reason\n")
+			os.Exit(Usage)
+		}
+		if err := CheckReason(o.reason); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(Usage)
+		}
+		paths := append(append([]string{requestFlag}, flag.Args()...), listed...)
+		o.sandbox(paths)
+		os.Exit(finish(requestDelegation(paths, o.reason)))
+	case "approve", "reject":
+		var grant Grant
+		if approveFlag != "" {
+			grant = o.grant()
+		}
+		ids := append(append([]string{approveFlag + rejectFlag}, flag.Args()...), listed...)
+		o.sandbox(nil)
+		os.Exit(finish(decideRequests(ids, approveFlag != "", grant)))
+	case "pending":
+		o.sandbox(nil)
+		os.Exit(finish(listPendingRequests()))
+	case "requests":
+		o.sandbox(nil)
+		os.Exit(finish(listOwnRequests()))
+	case "apply":
+		m := o.manifest(applyFlag)
+		o.sandbox(m.paths())
+		os.Exit(finish(applyManifest(m, checkFlag)))
+	case "l", "explain":
+		paths := append(flag.Args(), listed...)
+		if len(paths) == 0 && o.filesFrom == "" {
+			paths = []string{"."}
+		}
+		o.sandbox(paths)
+		if listFlag {
+			os.Exit(finish(listDelegations(paths)))
+		}
+		os.Exit(finish(explain(paths)))
+	case "a":
+		grant := o.grant()
+		paths := append(flag.Args()[1:], listed...)
+		o.sandbox(paths)
+		os.Exit(finish(addDelegation(flag.Args()[0], paths, grant)))
+	case "d":
+		paths := append(flag.Args()[1:], listed...)
+		o.sandbox(paths)
+		os.Exit(finish(deleteDelegation(flag.Args()[0], paths)))
+	}
+
+	opts := o.takeOptions()
+	paths := append(flag.Args(), listed...)
+	o.sandbox(paths)
+	os.Exit(finish(takeOwnership(paths, opts)))
 }
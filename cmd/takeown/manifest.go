@@ -0,0 +1,454 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// Manifest declares the delegations established on a set of paths.  Each
+// path it lists ends up with exactly the delegations declared on it, and
+// the paths it does not list are left alone.
+//
+// A manifest is a YAML mapping with these keys:
+//
+//	groups:   names for lists of users, local to the manifest
+//	scopes:   names for sets of grant policies
+//	paths:    for each absolute path, a list of entries, each naming
+//	          users, groups, a scope, and further grant policies
+//
+// Grant policies are written as the long names of the options of the grant
+// command, such as include, owners or window.
+type Manifest struct {
+	Name  string
+	Paths []ManifestPath
+}
+
+// ManifestPath is a path listed in a manifest, with the grants declared on
+// it.
+type ManifestPath struct {
+	Path   string
+	Grants GrantList
+}
+
+// manifestMap is a YAML mapping whose keys keep the order they are written
+// in, so that paths are planned and reported in the order of the manifest.
+type manifestMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// manifestObject returns the mapping in v.  Where tells where the mapping
+// is in the manifest, for errors.
+func manifestObject(where string, v interface{}) (*manifestMap, error) {
+	o := &manifestMap{values: map[string]interface{}{}}
+	if v == nil {
+		// An empty value is an empty mapping.
+		return o, nil
+	}
+	items, ok := v.(yaml.MapSlice)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a mapping", where)
+	}
+	for _, item := range items {
+		key, ok := item.Key.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: key %v is not a string", where, item.Key)
+		}
+		if _, dup := o.values[key]; dup {
+			return nil, fmt.Errorf("%s: duplicate key %q", where, key)
+		}
+		o.keys = append(o.keys, key)
+		o.values[key] = item.Value
+	}
+	return o, nil
+}
+
+// ParseManifest parses the manifest.  The name is used in errors only.
+func ParseManifest(name string, data []byte) (*Manifest, error) {
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("error in manifest %s: %v", name, err)
+	}
+	m.Name = name
+	return m, nil
+}
+
+func parseManifest(data []byte) (*Manifest, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	root, err := manifestObject("manifest", doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range root.keys {
+		if key != "groups" && key != "scopes" && key != "paths" {
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	groups := map[string]UIDList{}
+	if v, ok := root.values["groups"]; ok {
+		n, err := manifestObject("groups", v)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range n.keys {
+			if groups[name], err = manifestUsers("group "+name, n.values[name]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	scopes := map[string]*manifestMap{}
+	if v, ok := root.values["scopes"]; ok {
+		n, err := manifestObject("scopes", v)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range n.keys {
+			where := "scope " + name
+			scope, err := manifestObject(where, n.values[name])
+			if err != nil {
+				return nil, err
+			}
+			// Scopes are checked even if no entry uses them.
+			if _, err := manifestGrant(where, scope, nil); err != nil {
+				return nil, err
+			}
+			scopes[name] = scope
+		}
+	}
+
+	v, ok := root.values["paths"]
+	if !ok {
+		return nil, fmt.Errorf("no paths listed")
+	}
+	n, err := manifestObject("paths", v)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	for _, path := range n.keys {
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("path %s is not absolute", path)
+		}
+		p := ManifestPath{Path: filepath.Clean(path), Grants: GrantList{}}
+		entries, ok := n.values[path].([]interface{})
+		if !ok && n.values[path] != nil {
+			return nil, fmt.Errorf("path %s: expected a list of entries", path)
+		}
+		// No entries revoke every delegation on the path.
+		for number, v := range entries {
+			where := fmt.Sprintf("entry %d of path %s", number+1, path)
+			entry, err := manifestObject(where, v)
+			if err != nil {
+				return nil, err
+			}
+			uids := UIDList{}
+			policies := &manifestMap{values: map[string]interface{}{}}
+			var scope *manifestMap
+			for _, key := range entry.keys {
+				value := entry.values[key]
+				switch key {
+				case "users":
+					users, err := manifestUsers(where, value)
+					if err != nil {
+						return nil, err
+					}
+					uids = append(uids, users...)
+				case "groups":
+					names, err := manifestStrings(where+": "+key, value)
+					if err != nil {
+						return nil, err
+					}
+					for _, name := range names {
+						group, ok := groups[name]
+						if !ok {
+							return nil, fmt.Errorf("%s: unknown group %q", where, name)
+						}
+						uids = append(uids, group...)
+					}
+				case "scope":
+					name, err := manifestString(where+": "+key, value)
+					if err != nil {
+						return nil, err
+					}
+					if scope, ok = scopes[name]; !ok {
+						return nil, fmt.Errorf("%s: unknown scope %q", where, name)
+					}
+				default:
+					policies.keys = append(policies.keys, key)
+					policies.values[key] = value
+				}
+			}
+			if len(uids) == 0 {
+				return nil, fmt.Errorf("%s: entry names no users or groups", where)
+			}
+			grant, err := manifestGrant(where, scope, policies)
+			if err != nil {
+				return nil, err
+			}
+			for _, uid := range uids {
+				if p.Grants.Find(uid) != nil {
+					return nil, fmt.Errorf("%s: user %s is declared twice on %s", where, uidToUserOrStringifiedUid(uid), path)
+				}
+				g := grant
+				g.UID = uid
+				p.Grants = append(p.Grants, g)
+			}
+		}
+		m.Paths = append(m.Paths, p)
+	}
+	return m, nil
+}
+
+// manifestString returns the string in v.  Numbers are taken as they are
+// written, so that limits and users may be written either way.
+func manifestString(where string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("%s: expected a string", where)
+}
+
+// manifestStrings returns the list of strings in v.  A single string counts
+// as a list of one.
+func manifestStrings(where string, v interface{}) ([]string, error) {
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	list := []string{}
+	for _, item := range items {
+		s, err := manifestString(where, item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: expected a string or a list of strings", where)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// manifestBool returns the boolean in v.
+func manifestBool(where string, v interface{}) (bool, error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s: expected true or false", where)
+	}
+	return b, nil
+}
+
+// manifestUsers returns the UIDs of the users listed in v.
+func manifestUsers(where string, v interface{}) (UIDList, error) {
+	names, err := manifestStrings(where, v)
+	if err != nil {
+		return nil, err
+	}
+	uids := UIDList{}
+	for _, name := range names {
+		uid, err := userToUidOrStringUid(PotentialUsername(name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: error determining UID for user %s: %v", where, name, err)
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// manifestGrant builds the grant template out of the policies of the
+// scope, if any, and then of the entry, which override them.
+func manifestGrant(where string, scope *manifestMap, entry *manifestMap) (Grant, error) {
+	o := &options{}
+	for _, policies := range []*manifestMap{scope, entry} {
+		if policies == nil {
+			continue
+		}
+		for _, key := range policies.keys {
+			if err := o.setPolicy(key, policies.values[key]); err != nil {
+				return Grant{}, fmt.Errorf("%s: %v", where, err)
+			}
+		}
+	}
+	grant, _, err := o.newGrant()
+	if err != nil {
+		return Grant{}, fmt.Errorf("%s: %v", where, err)
+	}
+	return grant, nil
+}
+
+// setPolicy sets the grant option named by the key to the value v.
+func (o *options) setPolicy(key string, v interface{}) error {
+	strs := map[string]*string{
+		"max-files":       &o.maxFiles,
+		"max-bytes":       &o.maxBytes,
+		"max-daily-files": &o.maxDailyFiles,
+		"timezone":        &o.timezone,
+		"home":            &o.home,
+		"file-mode":       &o.fileMode,
+		"dir-mode":        &o.dirMode,
+		"umask":           &o.umask,
+		"acl":             &o.acl,
+	}
+	bools := map[string]*bool{
+		"dispatch":      &o.dispatch,
+		"manage":        &o.manage,
+		"once":          &o.once,
+		"allow-release": &o.allowRelease,
+	}
+	lists := map[string]*patternList{
+		"include": &o.include,
+		"exclude": &o.exclude,
+	}
+	var err error
+	if p, ok := strs[key]; ok {
+		*p, err = manifestString(key, v)
+		return err
+	}
+	if p, ok := bools[key]; ok {
+		*p, err = manifestBool(key, v)
+		return err
+	}
+	if p, ok := lists[key]; ok {
+		*p, err = manifestStrings(key, v)
+		return err
+	}
+	switch key {
+	case "owners":
+		owners, err := manifestStrings(key, v)
+		o.owners = strings.Join(owners, ",")
+		return err
+	case "window":
+		windows, err := manifestStrings(key, v)
+		if err != nil {
+			return err
+		}
+		o.windows = windowList{}
+		for _, s := range windows {
+			w, err := ParseTimeWindow(s)
+			if err != nil {
+				return err
+			}
+			o.windows = append(o.windows, w)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown key %q", key)
+}
+
+// manifestChange is a change to the grants on a path needed for them to
+// match a manifest.  Old is nil for grants to add, and New for grants to
+// revoke.
+type manifestChange struct {
+	Path string
+	Old  *Grant
+	New  *Grant
+}
+
+func describePolicies(g Grant) string {
+	if s := g.String(); s != "" {
+		return s
+	}
+	return "no policies"
+}
+
+func (c manifestChange) String() string {
+	switch {
+	case c.Old == nil:
+		s := fmt.Sprintf("add delegation for %s on %s", uidToUserOrStringifiedUid(c.New.UID), c.Path)
+		if policies := c.New.String(); policies != "" {
+			s = s + " (" + policies + ")"
+		}
+		return s
+	case c.New == nil:
+		return fmt.Sprintf("remove delegation for %s on %s", uidToUserOrStringifiedUid(c.Old.UID), c.Path)
+	}
+	return fmt.Sprintf("change delegation for %s on %s from %s to %s", uidToUserOrStringifiedUid(c.New.UID), c.Path, describePolicies(*c.Old), describePolicies(*c.New))
+}
+
+// grant returns the grant the change establishes or, when revoking, the
+// grant to the user whose delegation is revoked.
+func (c manifestChange) grant() Grant {
+	if c.New != nil {
+		return *c.New
+	}
+	return Grant{UID: c.Old.UID}
+}
+
+// PathPlan is what matching a manifest does to one of its paths.  The
+// plans hold their paths open, and must be closed once done with.
+type PathPlan struct {
+	ManifestPath
+	target *grantTarget
+	// original is the grants attribute of the path as it was, to roll
+	// back to.
+	original *[]byte
+	Changes  []manifestChange
+}
+
+// Plan compares the delegations the manifest declares with those
+// established on its paths.  Paths are opened once, with openGrantTarget, so
+// they are looked up with the credentials of the calling user and symbolic
+// links are refused, and the changes are later checked and made on the
+// files the plans hold open.
+func (m *Manifest) Plan() (plans []PathPlan, err error) {
+	defer func() {
+		if err != nil {
+			closePlans(plans)
+			plans = nil
+		}
+	}()
+	seen := map[string]string{}
+	for _, p := range m.Paths {
+		target, err := openGrantTarget(p.Path)
+		if err != nil {
+			return plans, err
+		}
+		plans = append(plans, PathPlan{p, target, nil, []manifestChange{}})
+		plan := &plans[len(plans)-1]
+		if other, ok := seen[target.real]; ok {
+			return plans, fmt.Errorf("paths %s and %s are the same", other, p.Path)
+		}
+		seen[target.real] = p.Path
+		for _, g := range p.Grants {
+			if !target.fs.Dir && (len(g.Include) > 0 || len(g.Exclude) > 0) {
+				return plans, NewError("add grant", p.Path, patternsOnFile)
+			}
+		}
+		if plan.original, err = target.attr(); err != nil {
+			return plans, err
+		}
+		established, err := target.Grants()
+		if err != nil {
+			return plans, err
+		}
+		for n := range p.Grants {
+			g := &p.Grants[n]
+			old := established.Find(g.UID)
+			if old == nil || !old.Equal(*g) {
+				plan.Changes = append(plan.Changes, manifestChange{p.Path, old, g})
+			}
+		}
+		for n := range established {
+			if p.Grants.Find(established[n].UID) == nil {
+				plan.Changes = append(plan.Changes, manifestChange{p.Path, &established[n], nil})
+			}
+		}
+	}
+	return plans, nil
+}
+
+// closePlans closes the paths the plans hold open.
+func closePlans(plans []PathPlan) {
+	for _, plan := range plans {
+		plan.target.Close()
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The help and the manual page are both produced from the descriptions of
+// the commands and flags, and from the tables below, so they cannot drift
+// apart from what the program accepts.
+
+const manualName = "delegate file ownership takeover to unprivileged users"
+
+// manualDescription is the description of takeown in the manual page, one
+// paragraph per entry.
+var manualDescription = []string{
+	"takeown lets the administrator delegate taking ownership of files and directories to users other than the administrator.  It is installed set-uid root, or with the file capabilities " + capabilitiesSpec + ", to gain the privileges needed to do so.",
+	"The administrator grants a user a delegation on a directory, which covers everything under it, or on a single file.  The user may then take ownership of the files covered, give it away to other delegated users, or hand it back, as the grant allows.  Grants may restrict which files are covered, whose files may be taken, how many files may be taken, and the mode and ACLs the files end up with.",
+	"The first argument may name a command, whose options follow GNU conventions.  Otherwise, the original interface applies, where single-letter flags select the action.",
+}
+
+// legacySynopsis returns the forms of the original interface, one for each
+// action in legacyModes.  The flags that set the policies of grants are
+// summed up as GRANT OPTION.
+func legacySynopsis() []string {
+	synopsis := []string{}
+	for _, m := range legacyModes {
+		if f := findLegacyFlag(m.flag); f != nil && f.hidden {
+			continue
+		}
+		words := []string{}
+		if m.flag != "" {
+			words = append(words, flagUsage(m.flag))
+		}
+		grant := false
+		for _, name := range m.flags {
+			if isGrantFlag(name) {
+				if !grant {
+					words = append(words, "[GRANT OPTION]...")
+				}
+				grant = true
+				continue
+			}
+			words = append(words, "["+flagUsage(name)+"]")
+		}
+		if m.args != "" {
+			words = append(words, m.args)
+		}
+		synopsis = append(synopsis, strings.Join(words, " "))
+	}
+	return synopsis
+}
+
+// flagUsage returns the flag with the name as it is written on the command
+// line, along with its argument.
+func flagUsage(name string) string {
+	if f := findLegacyFlag(name); f != nil && f.arg != "" {
+		return "-" + name + " " + f.arg
+	}
+	return "-" + name
+}
+
+func isGrantFlag(name string) bool {
+	for _, f := range grantFlags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// exitStatus describes an exit code of takeown.  When paths fail for
+// different reasons, the exit code combines their bits.
+type exitStatus struct {
+	code int
+	name string
+	help string
+}
+
+var exitStatuses = []exitStatus{
+	{Success, "Success", "every path was handled successfully"},
+	{Drift, "Drift", "with -check, the delegations established differ from the manifest"},
+	{BadConfig, "BadConfig", "the configuration of takeown, such as its audit log, is unsafe"},
+	{OperationError, "OperationError", "an operation on a path failed"},
+	{Usage, "Usage", "the command line was not valid"},
+	{PermissionDenied, "PermissionDenied", "the calling user may not perform an operation on a path"},
+}
+
+// manualFile describes a file or attribute takeown keeps its state in.
+type manualFile struct {
+	path string
+	help string
+}
+
+var manualFiles = []manualFile{
+	{ATTRNAME, "extended attribute of directories and files that holds the delegations established on them, as JSON"},
+	{AUDITFILE, "receives audit events, one JSON object per line, if it exists; it must be owned and only writable by root, or by the group takeown is set-gid to when installed with file capabilities"},
+	{USAGEFILE, "records how many files each delegation with a daily limit has let its user take today"},
+	{SPOOLFILE, "holds the requests for delegations, pending and decided; decided requests are kept for 90 days"},
+	{GRANTLOCK, "locked while delegations are changed or one-shot delegations used up, so concurrent runs of takeown do not lose each other's changes"},
+	{"/.trace", "lets users enable tracing with -T if it exists"},
+}
+
+// writeHelp prints the usage of takeown, its commands, the flags of the
+// original interface and its exit codes.
+func writeHelp(w io.Writer) {
+	fmt.Fprintf(w, "Usage: takeown COMMAND [OPTION]... [ARGUMENT]...\n")
+	for _, s := range legacySynopsis() {
+		fmt.Fprintf(w, "  or:  takeown %s\n", s)
+	}
+	fmt.Fprintf(w, "\n%s%s.\n\n", strings.ToUpper(manualName[:1]), manualName[1:])
+	listCommands(w)
+	fmt.Fprintf(w, "\nFlags of the original interface:\n")
+	for _, f := range legacyFlags {
+		if f.hidden {
+			continue
+		}
+		names := "-" + f.name
+		if f.arg != "" {
+			names = names + " " + f.arg
+		}
+		fmt.Fprintf(w, "  %-28s %s\n", names, f.help)
+	}
+	fmt.Fprintf(w, "\nExit status:\n")
+	for _, e := range exitStatuses {
+		fmt.Fprintf(w, "  %-4d %s\n", e.code, e.help)
+	}
+	fmt.Fprintf(w, "\nRun 'takeown help COMMAND' for the options of each command, and\n'takeown -man' for the manual page.\n")
+}
+
+// roff escapes text for troff.
+func roff(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// paragraph joins the lines of text meant for the terminal.
+func paragraph(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// writeManual prints the manual page of takeown, in troff format.
+func writeManual(w io.Writer) {
+	fmt.Fprintf(w, ".TH TAKEOWN 1 \"\" \"takeown\" \"User Commands\"\n")
+	fmt.Fprintf(w, ".SH NAME\ntakeown \\- %s\n", roff(manualName))
+
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.nf\n")
+	for _, name := range commandNames {
+		fmt.Fprintf(w, "\\fBtakeown %s\\fR %s\n", name, roff(findCommand(name).synopsis))
+	}
+	for _, s := range legacySynopsis() {
+		fmt.Fprintf(w, "\\fBtakeown\\fR %s\n", roff(s))
+	}
+	fmt.Fprintf(w, ".fi\n")
+
+	fmt.Fprintf(w, ".SH DESCRIPTION\n")
+	for n, p := range manualDescription {
+		if n > 0 {
+			fmt.Fprintf(w, ".PP\n")
+		}
+		fmt.Fprintf(w, "%s\n", roff(p))
+	}
+
+	fmt.Fprintf(w, ".SH COMMANDS\n")
+	for _, name := range commandNames {
+		c := findCommand(name)
+		fmt.Fprintf(w, ".SS \"takeown %s %s\"\n%s\n", name, roff(c.synopsis), roff(paragraph(c.summary)))
+		for _, opt := range commandOptions(c) {
+			names := []string{}
+			for _, n := range opt.names {
+				names = append(names, "\\fB"+roff(n)+"\\fR")
+			}
+			arg := ""
+			if opt.arg != "" {
+				arg = "=\\fI" + opt.arg + "\\fR"
+			}
+			fmt.Fprintf(w, ".TP\n%s%s\n%s\n", strings.Join(names, ", "), arg, roff(opt.help))
+		}
+	}
+
+	fmt.Fprintf(w, ".SH OPTIONS\nFlags of the original interface, used when the first argument is not a command:\n")
+	for _, f := range legacyFlags {
+		if f.hidden {
+			continue
+		}
+		arg := ""
+		if f.arg != "" {
+			arg = " \\fI" + f.arg + "\\fR"
+		}
+		fmt.Fprintf(w, ".TP\n\\fB%s\\fR%s\n%s\n", roff("-"+f.name), arg, roff(f.help))
+	}
+
+	fmt.Fprintf(w, ".SH \"EXIT STATUS\"\nWhen paths fail for different reasons, the exit status combines the bits of each.\n")
+	for _, e := range exitStatuses {
+		fmt.Fprintf(w, ".TP\n\\fB%d\\fR (%s)\n%s\n", e.code, e.name, roff(e.help))
+	}
+
+	fmt.Fprintf(w, ".SH FILES\n")
+	for _, f := range manualFiles {
+		fmt.Fprintf(w, ".TP\n\\fI%s\\fR\n%s\n", roff(f.path), roff(f.help))
+	}
+
+	fmt.Fprintf(w, ".SH \"SEE ALSO\"\n\\fBchown\\fR(1), \\fBsetfacl\\fR(1), \\fBxattr\\fR(7)\n")
+}
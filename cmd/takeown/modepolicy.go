@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// modeBits are the mode bits that a mode policy may set.  The set-user-ID
+// and set-group-ID bits are deliberately left out.
+const modeBits = 01777
+
+// allModeBits is the mask that restricts no mode bits at all.
+const allModeBits = 07777
+
+// FileMode is a permission mode.  It is stored in grant records as an octal
+// string, so the records remain legible to administrators.
+type FileMode uint32
+
+func ParseFileMode(s string) (FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q", s)
+	}
+	if m&^modeBits != 0 {
+		return 0, fmt.Errorf("mode %q may not set bits outside of %04o", s, modeBits)
+	}
+	return FileMode(m), nil
+}
+
+func (m FileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+func (m FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+func (m *FileMode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	p, err := ParseFileMode(s)
+	if err != nil {
+		return err
+	}
+	*m = p
+	return nil
+}
+
+// ModePolicy decides the mode that files get when ownership of them is
+// taken.  Files and Dirs, when set, replace the mode of files and
+// directories respectively.  Umask, when set, is then masked off the mode.
+type ModePolicy struct {
+	Files *FileMode `json:"files,omitempty"`
+	Dirs  *FileMode `json:"dirs,omitempty"`
+	Umask *FileMode `json:"umask,omitempty"`
+}
+
+// NewModePolicy returns a policy out of the modes passed as strings.  Empty
+// strings leave the respective part of the policy unset.  If all strings are
+// empty, it returns nil.
+func NewModePolicy(files string, dirs string, umask string) (*ModePolicy, error) {
+	p := &ModePolicy{}
+	for _, x := range []struct {
+		s string
+		m **FileMode
+	}{{files, &p.Files}, {dirs, &p.Dirs}, {umask, &p.Umask}} {
+		if x.s == "" {
+			continue
+		}
+		m, err := ParseFileMode(x.s)
+		if err != nil {
+			return nil, err
+		}
+		*x.m = &m
+	}
+	if p.Files == nil && p.Dirs == nil && p.Umask == nil {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func (p *ModePolicy) String() string {
+	if p == nil {
+		return "keep mode"
+	}
+	s := ""
+	add := func(f string, args ...interface{}) {
+		if s != "" {
+			s = s + ", "
+		}
+		s = s + fmt.Sprintf(f, args...)
+	}
+	if p.Files != nil {
+		add("files %s", p.Files)
+	}
+	if p.Dirs != nil {
+		add("dirs %s", p.Dirs)
+	}
+	if p.Umask != nil {
+		add("umask %s", p.Umask)
+	}
+	return s
+}
+
+// Apply computes the mode that a file with the current mode should have
+// once ownership of it is taken, further restricted to the bits in mask.
+// It returns the computed mode, and whether it differs from the current one.
+// A nil policy keeps the current mode.
+func (p *ModePolicy) Apply(current FileMode, dir bool, mask FileMode) (FileMode, bool) {
+	m := current
+	if p != nil {
+		if dir && p.Dirs != nil {
+			m = *p.Dirs
+		} else if !dir && p.Files != nil {
+			m = *p.Files
+		}
+		if p.Umask != nil {
+			m = m &^ *p.Umask
+		}
+	}
+	m = m & mask
+	return m, m != current
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// patternList is a flag that may be given several times, each time adding
+// a glob pattern to the list.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, " ")
+}
+
+func (p *patternList) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
+
+// options holds the values of the command line options, whether they were
+// passed to a subcommand or in the original single-letter style.
+type options struct {
+	trace     bool
+	format    string
+	filesFrom string
+	nul       bool
+	noSandbox bool
+
+	// Options for taking ownership.
+	recursive   bool
+	simulate    bool
+	verbose     bool
+	mode        string
+	to          string
+	release     bool
+	ignoreQuota bool
+
+	// Options for granting delegations.
+	include       patternList
+	exclude       patternList
+	owners        string
+	maxFiles      string
+	maxBytes      string
+	maxDailyFiles string
+	windows       windowList
+	timezone      string
+	dispatch      bool
+	manage        bool
+	once          bool
+	allowRelease  bool
+	home          string
+	fileMode      string
+	dirMode       string
+	umask         string
+	acl           string
+
+	// Options for finding delegations.
+	user string
+
+	// Options for requesting delegations.
+	reason string
+
+	// Options for applying manifests.
+	check bool
+}
+
+// setup enables tracing and the output format, opens the audit log, and
+// returns the paths listed in the file passed with -files-from.  It exits
+// on errors.  A -0 without -files-from is left for callers to refuse.
+func (o *options) setup() []string {
+	if o.trace {
+		if set := setTrace(); !set {
+			fmt.Fprintf(os.Stderr, "error: the file /.trace must exist to enable tracing\n")
+			os.Exit(PermissionDenied)
+		}
+	}
+
+	if o.noSandbox {
+		if !isAdmin() {
+			fmt.Fprintf(os.Stderr, "error: only the administrator may disable the sandbox\n")
+			os.Exit(PermissionDenied)
+		}
+		sandboxDisabled = true
+	}
+
+	if f, err := ParseOutputFormat(o.format); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(Usage)
+	} else {
+		output = f
+	}
+
+	if err := openAuditLog(); err != nil {
+		fmt.Fprintf(os.Stderr, "error opening audit log: %v\n", err)
+		os.Exit(BadConfig)
+	}
+
+	listed := []string{}
+	if o.filesFrom != "" {
+		var err error
+		if listed, err = readPaths(o.filesFrom, o.nul); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading paths from %s: %v\n", o.filesFrom, err)
+			os.Exit(OperationError)
+		}
+	}
+	return listed
+}
+
+// sandbox confines takeown to working on the paths.  It exits on errors.
+func (o *options) sandbox(paths []string) {
+	if err := enterSandbox(paths); err != nil {
+		fmt.Fprintf(os.Stderr, "error entering sandbox: %v\n", err)
+		os.Exit(OperationError)
+	}
+}
+
+// grant builds the grant template out of the options.  It exits on errors.
+func (o *options) grant() Grant {
+	grant, status, err := o.newGrant()
+	if err != nil {
+		if status == Usage {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		os.Exit(status)
+	}
+	return grant
+}
+
+// newGrant builds the grant template out of the options.  On errors, it
+// also returns the exit status they call for.
+func (o *options) newGrant() (Grant, int, error) {
+	policy, err := NewModePolicy(o.fileMode, o.dirMode, o.umask)
+	if err != nil {
+		return Grant{}, Usage, err
+	}
+	aclPolicy, err := ParseACLPolicy(o.acl)
+	if err != nil {
+		return Grant{}, Usage, err
+	}
+	grant := Grant{Mode: policy, ACL: aclPolicy, Dispatch: o.dispatch, Release: o.allowRelease, Manage: o.manage, Once: o.once}
+	if o.home != "" {
+		uid, err := userToUidOrStringUid(PotentialUsername(o.home))
+		if err != nil {
+			return Grant{}, OperationError, fmt.Errorf("error determining UID for user %s: %v", o.home, err)
+		}
+		grant.Release = true
+		grant.Home = &uid
+	}
+	if o.owners != "" {
+		owners, err := ParseUIDRanges(o.owners)
+		if err != nil {
+			return Grant{}, OperationError, err
+		}
+		grant.Owners = owners
+	}
+	for _, pattern := range append(o.include, o.exclude...) {
+		if err := ValidatePattern(pattern); err != nil {
+			return Grant{}, Usage, err
+		}
+	}
+	grant.Include = o.include
+	grant.Exclude = o.exclude
+	grant.Limits, err = NewLimits(o.maxFiles, o.maxBytes, o.maxDailyFiles)
+	if err != nil {
+		return Grant{}, Usage, err
+	}
+	if o.timezone != "" {
+		if len(o.windows) == 0 {
+			return Grant{}, Usage, fmt.Errorf("a time zone only applies to time windows")
+		}
+		if _, err := time.LoadLocation(o.timezone); err != nil {
+			return Grant{}, Usage, fmt.Errorf("invalid time zone %q", o.timezone)
+		}
+	}
+	grant.Windows = o.windows
+	grant.Timezone = o.timezone
+	return grant, Success, nil
+}
+
+// manifest loads the manifest.  It exits on errors.
+func (o *options) manifest(name string) *Manifest {
+	m, status, err := loadManifest(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(status)
+	}
+	return m
+}
+
+// takeOptions builds the options for taking ownership.  It exits on
+// errors.  Callers must refuse -release along with -to beforehand.
+func (o *options) takeOptions() takeOptions {
+	opts := takeOptions{
+		Recursive: o.recursive,
+		Simulate:  o.simulate,
+		Verbose:   o.verbose,
+		Mask:      allModeBits,
+		To:        UID(os.Getuid()),
+		Release:   o.release,
+	}
+	if o.mode != "" {
+		m, err := ParseFileMode(o.mode)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(Usage)
+		}
+		opts.Mask = m
+	}
+	if o.ignoreQuota {
+		if !isAdmin() {
+			fmt.Fprintf(os.Stderr, "error: only the administrator may ignore disk quotas\n")
+			os.Exit(PermissionDenied)
+		}
+		opts.IgnoreQuota = true
+	}
+	if o.to != "" {
+		uid, err := userToUidOrStringUid(PotentialUsername(o.to))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error determining UID for user %s: %v\n", o.to, err)
+			os.Exit(OperationError)
+		}
+		opts.To = uid
+	}
+	return opts
+}
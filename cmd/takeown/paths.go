@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func realpath(dir string) (string, error) {
@@ -29,5 +34,90 @@ func lstat(path string) (sinfo, error) {
 		return sinfo{}, err
 	}
 	statt := info.Sys().(*syscall.Stat_t)
-	return sinfo{statt.Uid, statt.Gid, info.IsDir(), islink(info)}, nil
+	return sinfo{
+		Uid:   statt.Uid,
+		Gid:   statt.Gid,
+		Dir:   info.IsDir(),
+		Link:  islink(info),
+		Mode:  FileMode(statt.Mode & allModeBits),
+		Dev:   uint64(statt.Dev),
+		Ino:   uint64(statt.Ino),
+		Space: uint64(statt.Blocks) * 512,
+	}, nil
+}
+
+// fstat is like lstat, for a descriptor.
+func fstat(fd int) (sinfo, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return sinfo{}, err
+	}
+	return sinfo{
+		Uid:   st.Uid,
+		Gid:   st.Gid,
+		Dir:   st.Mode&unix.S_IFMT == unix.S_IFDIR,
+		Link:  st.Mode&unix.S_IFMT == unix.S_IFLNK,
+		Mode:  FileMode(st.Mode & allModeBits),
+		Dev:   uint64(st.Dev),
+		Ino:   uint64(st.Ino),
+		Space: uint64(st.Blocks) * 512,
+	}, nil
+}
+
+// lchmod changes the mode of the path without following it if it is a
+// symbolic link, in which case it fails with ELOOP.
+func lchmod(path string, mode FileMode) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return &os.PathError{Op: "chmod", Path: path, Err: unix.ELOOP}
+	}
+	// Descriptors opened with O_PATH cannot be fchmod()ed, but the kernel
+	// lets us chmod() the file they refer to through /proc.
+	if err := unix.Chmod(fmt.Sprintf("/proc/self/fd/%d", fd), uint32(mode)); err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	return nil
+}
+
+// readPaths reads a list of paths, one per line or, if nul is set, each
+// terminated by a NUL character, from the file named source, or from the
+// standard input if source is -.  Empty entries are skipped.  The file is
+// opened as the calling user, so that user must be able to read it.
+func readPaths(source string, nul bool) ([]string, error) {
+	f := os.Stdin
+	if source != "-" {
+		err := asCallingUser(func() error {
+			var err error
+			f, err = os.Open(source)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	sep := []byte("\n")
+	if nul {
+		sep = []byte("\x00")
+	}
+	paths := []string{}
+	for _, entry := range bytes.Split(data, sep) {
+		if len(entry) == 0 {
+			continue
+		}
+		paths = append(paths, string(entry))
+	}
+	return paths, nil
 }
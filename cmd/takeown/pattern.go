@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ValidatePattern returns an error if the glob pattern is malformed.
+func ValidatePattern(pattern string) error {
+	for _, seg := range strings.Split(strings.Trim(pattern, "/"), "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if strings.Trim(pattern, "/") == "" {
+		return fmt.Errorf("invalid pattern %q: pattern is empty", pattern)
+	}
+	return nil
+}
+
+// matchSegments matches path components against pattern components, where
+// a ** component stands for any number of path components.
+func matchSegments(p []string, r []string) bool {
+	if len(p) == 0 {
+		return len(r) == 0
+	}
+	if p[0] == "**" {
+		for n := 0; n <= len(r); n++ {
+			if matchSegments(p[1:], r[n:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(r) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(p[0], r[0]); !ok {
+		return false
+	}
+	return matchSegments(p[1:], r[1:])
+}
+
+// matchPattern matches a slash-separated path, relative to the directory
+// carrying a grant, against a glob pattern.  Patterns without slashes match
+// the name of the file, at any depth.  Patterns with slashes match the path
+// from the directory down.  A path also matches when any directory leading
+// to it within the delegated directory does, so patterns naming directories
+// cover their contents.
+func matchPattern(pattern string, rel string) bool {
+	if rel == "." || rel == "" {
+		return false
+	}
+	segs := strings.Split(rel, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, seg := range segs {
+			if ok, _ := path.Match(pattern, seg); ok {
+				return true
+			}
+		}
+		return false
+	}
+	psegs := strings.Split(strings.Trim(pattern, "/"), "/")
+	for n := 1; n <= len(segs); n++ {
+		if matchSegments(psegs, segs[:n]) {
+			return true
+		}
+	}
+	return false
+}
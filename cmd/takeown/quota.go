@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Commands and structures of quotactl(2), which the unix package lacks.
+const (
+	qGetQuota = 0x800007
+	usrQuota  = 0
+	qifLimits = 0x5 // QIF_BLIMITS | QIF_ILIMITS
+)
+
+type ifDqblk struct {
+	BHardLimit uint64
+	BSoftLimit uint64
+	CurSpace   uint64
+	IHardLimit uint64
+	ISoftLimit uint64
+	CurInodes  uint64
+	BTime      uint64
+	ITime      uint64
+	Valid      uint32
+}
+
+// Quota is the disk quota of a user on a file system.  Limits of zero mean
+// there is no limit.
+type Quota struct {
+	SpaceHard  uint64
+	SpaceSoft  uint64
+	SpaceUsed  uint64
+	InodesHard uint64
+	InodesSoft uint64
+	InodesUsed uint64
+}
+
+// Transfer totals the files whose ownership would change hands, on a single
+// file system.
+type Transfer struct {
+	// Path is a directory on the file system, used to query quotas.
+	Path   string
+	Bytes  uint64
+	Inodes uint64
+}
+
+func (t *Transfer) String() string {
+	if t.Inodes == 1 {
+		return fmt.Sprintf("%d bytes in 1 file", t.Bytes)
+	}
+	return fmt.Sprintf("%d bytes in %d files", t.Bytes, t.Inodes)
+}
+
+// quotaCommand builds the quotactl(2) command to get user quotas.
+func quotaCommand() int {
+	return qGetQuota<<8 | usrQuota
+}
+
+// mountSource finds the device mounted at the file system with the device
+// number dev, by looking it up in the mount table.
+func mountSource(dev uint64) (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	want := fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev))
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != want {
+			continue
+		}
+		for n, field := range fields {
+			if field == "-" && n+2 < len(fields) {
+				return fields[n+2], nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", unix.ENODEV
+}
+
+// noQuotas returns true if quotactl(2) failed with errno because the file
+// system does not enforce quotas, or the kernel does not support them,
+// rather than because the quota could not be read.
+func noQuotas(errno unix.Errno) bool {
+	switch errno {
+	case unix.ESRCH, unix.ENOSYS, unix.EOPNOTSUPP, unix.ENOTBLK:
+		return true
+	}
+	return false
+}
+
+// GetQuota returns the quota of the user on the file system containing the
+// directory.  If the file system does not enforce quotas, it returns nil.
+func GetQuota(dir string, uid UID) (*Quota, error) {
+	// An O_PATH descriptor is enough for quotactl_fd, and does not need
+	// the sandbox to let takeown read the directory.
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, NewError("open", dir, err)
+	}
+	defer unix.Close(fd)
+
+	var dq ifDqblk
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, uintptr(fd), uintptr(quotaCommand()), uintptr(uid), uintptr(unsafe.Pointer(&dq)), 0, 0)
+	if errno == unix.ENOSYS {
+		// Kernels older than 5.14 need the device instead.  File systems
+		// mounted from something other than a device file, such as
+		// tmpfs, cannot have quotas there.
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			return nil, NewError("stat", dir, err)
+		}
+		source, err := mountSource(st.Dev)
+		if err != nil {
+			return nil, NewError("find device of", dir, err)
+		}
+		if !strings.HasPrefix(source, "/") {
+			return nil, nil
+		}
+		special, err := unix.BytePtrFromString(source)
+		if err != nil {
+			return nil, NewError("find device of", dir, err)
+		}
+		_, _, errno = unix.Syscall6(unix.SYS_QUOTACTL, uintptr(quotaCommand()), uintptr(unsafe.Pointer(special)), uintptr(uid), uintptr(unsafe.Pointer(&dq)), 0, 0)
+	}
+	if noQuotas(errno) {
+		return nil, nil
+	} else if errno != 0 {
+		return nil, NewError("quotactl", dir, errno)
+	}
+	if dq.Valid&qifLimits == 0 {
+		return nil, nil
+	}
+	return &Quota{
+		SpaceHard:  dq.BHardLimit * 1024,
+		SpaceSoft:  dq.BSoftLimit * 1024,
+		SpaceUsed:  dq.CurSpace,
+		InodesHard: dq.IHardLimit,
+		InodesSoft: dq.ISoftLimit,
+		InodesUsed: dq.CurInodes,
+	}, nil
+}
+
+func exceeds(used uint64, added uint64, limit uint64) bool {
+	return limit != 0 && used+added > limit
+}
+
+// Check returns whether the transfer would push usage past the hard and the
+// soft limits of the quota.
+func (q *Quota) Check(t *Transfer) (hard bool, soft bool) {
+	if q == nil {
+		return false, false
+	}
+	hard = exceeds(q.SpaceUsed, t.Bytes, q.SpaceHard) || exceeds(q.InodesUsed, t.Inodes, q.InodesHard)
+	soft = exceeds(q.SpaceUsed, t.Bytes, q.SpaceSoft) || exceeds(q.InodesUsed, t.Inodes, q.InodesSoft)
+	return
+}
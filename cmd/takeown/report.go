@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// OutputFormat decides how takeown reports the outcome of each path.
+type OutputFormat string
+
+const (
+	// FormatText prints messages meant for people, errors to standard
+	// error and the rest to standard output.
+	FormatText OutputFormat = "text"
+	// FormatJSON prints a single JSON document with all the results
+	// once the command is done.
+	FormatJSON OutputFormat = "json"
+	// FormatNUL prints every result as it happens, as records of five
+	// fields each terminated by a NUL character: status, path, message,
+	// user and source.  Results detailing delegations print one record per
+	// delegation instead, with the verdict, if any, for message.
+	FormatNUL OutputFormat = "nul"
+)
+
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch f := OutputFormat(s); f {
+	case FormatText, FormatJSON, FormatNUL:
+		return f, nil
+	}
+	return FormatText, fmt.Errorf("invalid output format %q (valid formats are %s, %s and %s)", s, FormatText, FormatJSON, FormatNUL)
+}
+
+var output = FormatText
+
+// ResultError details the error that made a path fail.
+type ResultError struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	Err    string `json:"error"`
+}
+
+// newResultError details err, which happened while carrying out the action
+// on the path.  Errors that already name an action and a path keep them.
+func newResultError(action string, path string, err error) *ResultError {
+	var e *Error
+	if errors.As(err, &e) {
+		return &ResultError{e.Action, e.Path, e.Err.Error()}
+	}
+	return &ResultError{action, path, err.Error()}
+}
+
+// ResultDelegation is a delegation listed or explained for a path.
+type ResultDelegation struct {
+	User  string      `json:"user"`
+	Path  string      `json:"path"`
+	File  bool        `json:"file,omitempty"`
+	Grant grantRecord `json:"grant"`
+	// Verdict explains whether the delegation applies to the path.
+	Verdict string `json:"verdict,omitempty"`
+}
+
+func newResultDelegation(d Delegation, verdict string) ResultDelegation {
+	return ResultDelegation{string(uidToUserOrStringifiedUid(d.UID)), d.Path, d.File, grantRecord(d.Grant), verdict}
+}
+
+// Result is the outcome of an action on a path.  Status is one of the exit
+// codes of takeown.
+type Result struct {
+	Action  string `json:"action"`
+	Path    string `json:"path"`
+	Status  int    `json:"status"`
+	Warning bool   `json:"warning,omitempty"`
+	// Message is what takeown prints about the result in text format.
+	Message     string             `json:"message,omitempty"`
+	Error       *ResultError       `json:"error,omitempty"`
+	Delegations []ResultDelegation `json:"delegations,omitempty"`
+	Request     *DelegationRequest `json:"request,omitempty"`
+}
+
+var results = []Result{}
+
+// report makes the result known.  In text format, the message is printed
+// only if show is set, and goes to standard error for errors and warnings.
+// The other formats report every result.
+func report(r Result, show bool) {
+	switch output {
+	case FormatText:
+		if !show || r.Message == "" {
+			return
+		}
+		if r.Status != Success || r.Warning {
+			fmt.Fprintln(os.Stderr, r.Message)
+		} else {
+			fmt.Println(r.Message)
+		}
+	case FormatJSON:
+		results = append(results, r)
+	case FormatNUL:
+		if len(r.Delegations) == 0 {
+			fmt.Printf("%d\x00%s\x00%s\x00\x00\x00", r.Status, r.Path, r.Message)
+		}
+		for _, d := range r.Delegations {
+			fmt.Printf("%d\x00%s\x00%s\x00%s\x00%s\x00", r.Status, r.Path, d.Verdict, d.User, d.Path)
+		}
+	}
+}
+
+// reportError makes known that the action on the path failed with err.
+func reportError(action string, path string, status int, message string, err error) {
+	report(Result{Action: action, Path: path, Status: status, Message: message, Error: newResultError(action, path, err)}, true)
+}
+
+// finish prints the results collected in JSON format, and returns the exit
+// status of the command.
+func finish(status int) int {
+	if output != FormatJSON {
+		return status
+	}
+	data, err := json.MarshalIndent(struct {
+		Status  int      `json:"status"`
+		Results []Result `json:"results"`
+	}{status, results}, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error marshaling results: %v\n", err)
+		return status | OperationError
+	}
+	fmt.Println(string(data))
+	return status
+}
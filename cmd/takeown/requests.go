@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SPOOLFILE holds the requests users made for delegations, and what became
+// of them.
+var SPOOLFILE = statePath("/var/spool/takeown/requests.json")
+
+// requestRetention is how long decided requests stay in the spool, so that
+// their requesters may learn what became of them.
+const requestRetention = 90 * 24 * time.Hour
+
+// maxReasonLength is how long, in bytes, the reason given for a request
+// may be.
+const maxReasonLength = 500
+
+// maxPendingRequests is how many requests a user may have pending at once,
+// so that no user can grow the spool without bounds.
+const maxPendingRequests = 10
+
+type RequestStatus string
+
+const (
+	RequestPending  RequestStatus = "pending"
+	RequestApproved RequestStatus = "approved"
+	RequestRejected RequestStatus = "rejected"
+)
+
+// DelegationRequest is a request from a user for a delegation on a path.
+type DelegationRequest struct {
+	ID   uint64 `json:"id"`
+	UID  UID    `json:"uid"`
+	Path string `json:"path"`
+	// Dev and Ino identify the file or directory at the path when it was
+	// requested, which is the one approving the request must grant.
+	Dev    uint64        `json:"dev"`
+	Ino    uint64        `json:"ino"`
+	Reason string        `json:"reason"`
+	Time   time.Time     `json:"time"`
+	Status RequestStatus `json:"status"`
+	// DecidedBy and Decided record who approved or rejected the request,
+	// and when.
+	DecidedBy *UID       `json:"decided_by,omitempty"`
+	Decided   *time.Time `json:"decided,omitempty"`
+}
+
+// String describes the request the way takeown lists pending ones.
+func (r DelegationRequest) String() string {
+	return fmt.Sprintf("request %d from %s on %s: %s", r.ID, uidToUserOrStringifiedUid(r.UID), r.Path, r.Reason)
+}
+
+// spoolRecord is the content of the spool file.
+type spoolRecord struct {
+	Next     uint64              `json:"next"`
+	Requests []DelegationRequest `json:"requests"`
+}
+
+// RequestSpool is the spool file, locked for as long as it stays open.
+type RequestSpool struct {
+	f *os.File
+	spoolRecord
+}
+
+// OpenSpool opens and locks the spool file, creating it if need be.  It
+// refuses to use a file that anyone but the administrator could modify.
+func OpenSpool() (*RequestSpool, error) {
+	f, err := openStateFile(SPOOLFILE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &RequestSpool{f, spoolRecord{Next: 1}}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.spoolRecord); err != nil {
+			s.Close()
+			return nil, NewError("unmarshal", SPOOLFILE, err)
+		}
+	}
+	return s, nil
+}
+
+// CheckReason refuses reasons that are empty or too long, and those with
+// control characters, which would reach the terminals of the users listing
+// requests.
+func CheckReason(reason string) error {
+	if reason == "" {
+		return fmt.Errorf("a reason is required")
+	}
+	if len(reason) > maxReasonLength {
+		return fmt.Errorf("the reason may be at most %d bytes long", maxReasonLength)
+	}
+	if !utf8.ValidString(reason) {
+		return fmt.Errorf("the reason is not valid UTF-8")
+	}
+	for _, c := range reason {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("the reason may not contain control characters")
+		}
+	}
+	return nil
+}
+
+// Add records a pending request from the user for a delegation on the real
+// path, which is the file or directory fs describes.  If the user already
+// has one pending on it, it returns that one instead.  Users may only have
+// up to maxPendingRequests pending.
+func (s *RequestSpool) Add(uid UID, real string, fs sinfo, reason string) (*DelegationRequest, error) {
+	pending := 0
+	for n, r := range s.Requests {
+		if r.UID != uid || r.Status != RequestPending {
+			continue
+		}
+		if r.Path == real && r.Dev == fs.Dev && r.Ino == fs.Ino {
+			return &s.Requests[n], nil
+		}
+		pending++
+	}
+	if pending >= maxPendingRequests {
+		return nil, fmt.Errorf("too many pending requests; at most %d may be pending at once", maxPendingRequests)
+	}
+	s.Requests = append(s.Requests, DelegationRequest{
+		ID:     s.Next,
+		UID:    uid,
+		Path:   real,
+		Dev:    fs.Dev,
+		Ino:    fs.Ino,
+		Reason: reason,
+		Time:   time.Now().UTC(),
+		Status: RequestPending,
+	})
+	s.Next++
+	return &s.Requests[len(s.Requests)-1], nil
+}
+
+// Open opens the path of the request, as openGrantTarget does, and checks
+// that it still is the file or directory that was requested: not a symbolic
+// link, its own real path, and the same file.  Otherwise, the path may have
+// been swapped for another since, and approving the request would grant the
+// wrong one.
+func (r *DelegationRequest) Open() (*grantTarget, error) {
+	changed := fmt.Errorf("%s is no longer the path requested", r.Path)
+	target, err := openGrantTarget(r.Path)
+	if errors.Is(err, grantsOnLink) {
+		trace("  %s is now a symbolic link", r.Path)
+		return nil, changed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if target.real != r.Path {
+		trace("  %s now resolves to %s", r.Path, target.real)
+		target.Close()
+		return nil, changed
+	}
+	if target.fs.Dev != r.Dev || target.fs.Ino != r.Ino {
+		trace("  %s is now device %d inode %d, not device %d inode %d", r.Path, target.fs.Dev, target.fs.Ino, r.Dev, r.Ino)
+		target.Close()
+		return nil, changed
+	}
+	return target, nil
+}
+
+// Find returns the request with the ID, or nil if there is none.
+func (s *RequestSpool) Find(id uint64) *DelegationRequest {
+	for n := range s.Requests {
+		if s.Requests[n].ID == id {
+			return &s.Requests[n]
+		}
+	}
+	return nil
+}
+
+// Decide approves or rejects the request on behalf of the user.
+func (s *RequestSpool) Decide(r *DelegationRequest, status RequestStatus, by UID) {
+	now := time.Now().UTC()
+	r.Status = status
+	r.DecidedBy = &by
+	r.Decided = &now
+}
+
+// Save writes the spool file, dropping requests decided long ago.
+func (s *RequestSpool) Save() error {
+	kept := []DelegationRequest{}
+	for _, r := range s.Requests {
+		if r.Decided != nil && time.Since(*r.Decided) > requestRetention {
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.Requests = kept
+	data, err := json.Marshal(s.spoolRecord)
+	if err != nil {
+		return NewError("marshal", SPOOLFILE, err)
+	}
+	if err := s.f.Truncate(0); err != nil {
+		return NewError("write", SPOOLFILE, err)
+	}
+	if _, err := s.f.WriteAt(data, 0); err != nil {
+		return NewError("write", SPOOLFILE, err)
+	}
+	return nil
+}
+
+// Close releases the lock on the spool file.
+func (s *RequestSpool) Close() error {
+	return s.f.Close()
+}
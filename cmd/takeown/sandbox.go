@@ -0,0 +1,128 @@
+package main
+
+import (
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Once takeown knows which paths it will work on, it confines itself, so a
+// bug in it or in the libraries it runs cannot be turned into running
+// arbitrary programs or writing arbitrary files as root.  A seccomp filter
+// limits all threads to the system calls takeown needs, and Landlock, if the
+// kernel supports it, limits the thread that does the work to reading the
+// paths it was passed and the system files name lookups need.
+
+// sandboxDisabled is set by the administrator with -no-sandbox.
+var sandboxDisabled bool
+
+// Access rights Landlock handles, by version of its ABI.
+const (
+	landlockAccessFSv1 = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR | unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK | unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+	landlockAccessFSRefer    = 1 << 13
+	landlockAccessFSTruncate = 1 << 14
+
+	// landlockFileAccess are the rights that apply to files, as opposed
+	// to directories.
+	landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | landlockAccessFSTruncate
+	landlockRead = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+)
+
+// systemPaths are read by the C library and name service modules to look
+// up users and groups.
+var systemPaths = []string{"/etc", "/usr", "/lib", "/lib64", "/var/lib/sss", "/var/db", "/proc/self"}
+
+// stateDirs hold the files takeown keeps its state in.
+var stateDirs = []string{filepath.Dir(USAGEFILE), filepath.Dir(SPOOLFILE)}
+
+// restrictFilesystem limits the current thread, and the threads it starts,
+// to reading the paths and system files, and to writing its state files.  It
+// does nothing if the kernel lacks Landlock.
+func restrictFilesystem(paths []string) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		trace("Landlock is not available: %v", errno)
+		return nil
+	}
+	handled := uint64(landlockAccessFSv1)
+	if abi >= 2 {
+		handled |= landlockAccessFSRefer
+	}
+	if abi >= 3 {
+		handled |= landlockAccessFSTruncate
+	}
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return NewError("create", "Landlock ruleset", errno)
+	}
+	defer unix.Close(int(fd))
+
+	allow := func(path string, access uint64) error {
+		pfd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			// Paths that cannot be opened cannot be used either.
+			trace("  not allowing access to %s: %v", path, err)
+			return nil
+		}
+		defer unix.Close(pfd)
+		var st unix.Stat_t
+		if err := unix.Fstat(pfd, &st); err != nil {
+			return NewError("stat", path, err)
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			access &= landlockFileAccess
+		}
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access & handled, Parent_fd: int32(pfd)}
+		if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+			return NewError("allow access to", path, errno)
+		}
+		trace("  allowing access %#x to %s", access&handled, path)
+		return nil
+	}
+	for _, path := range append(paths, systemPaths...) {
+		if err := allow(path, landlockRead); err != nil {
+			return err
+		}
+	}
+	// The directories of the state files cannot be created once confined.
+	state := unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_REG | landlockAccessFSTruncate
+	for _, dir := range stateDirs {
+		if err := makeStateDir(dir); err != nil {
+			trace("  cannot create %s: %v", dir, err)
+		}
+		if err := allow(dir, uint64(state)); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return NewError("enforce", "Landlock ruleset", errno)
+	}
+	return nil
+}
+
+// enterSandbox confines takeown to working on the paths, unless the
+// administrator disabled the sandbox.
+func enterSandbox(paths []string) error {
+	if sandboxDisabled {
+		trace("sandbox disabled")
+		return nil
+	}
+	trace("entering sandbox for %q", paths)
+	// Both Landlock and seccomp filters require this without
+	// CAP_SYS_ADMIN, and takeown never runs other programs anyway.
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return NewError("set", "no_new_privs", err)
+	}
+	if err := restrictFilesystem(paths); err != nil {
+		return err
+	}
+	return installSeccompFilter()
+}
@@ -0,0 +1,14 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// auditArch is AUDIT_ARCH_X86_64.
+const auditArch = 0xc000003e
+
+// archSyscalls are the system calls takeown needs that do not exist on every
+// architecture.
+var archSyscalls = []uintptr{
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_NEWFSTATAT, unix.SYS_ACCESS, unix.SYS_READLINK,
+	unix.SYS_GETDENTS, unix.SYS_MKDIR, unix.SYS_CHMOD, unix.SYS_CHOWN, unix.SYS_LCHOWN, unix.SYS_PIPE, unix.SYS_DUP2,
+	unix.SYS_POLL, unix.SYS_SELECT, unix.SYS_EPOLL_WAIT, unix.SYS_ARCH_PRCTL, unix.SYS_GETRLIMIT, unix.SYS_TIME,
+}
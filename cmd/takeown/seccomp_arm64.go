@@ -0,0 +1,10 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// auditArch is AUDIT_ARCH_AARCH64.
+const auditArch = 0xc00000b7
+
+// archSyscalls are the system calls takeown needs that do not exist on every
+// architecture.
+var archSyscalls = []uintptr{unix.SYS_FSTATAT, unix.SYS_GETRLIMIT}
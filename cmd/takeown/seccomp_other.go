@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package main
+
+import "runtime"
+
+// installSeccompFilter does nothing on architectures without a filter.
+func installSeccompFilter() error {
+	trace("no seccomp filter for %s", runtime.GOARCH)
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// stateRoot is the directory the state files are kept under.  The tests
+// build takeown with -ldflags "-X main.stateRoot=DIR", so that they leave the
+// state of the system they run on alone.
+var stateRoot = "/"
+
+// statePath returns where the state file at path is kept.
+func statePath(path string) string {
+	return filepath.Join(stateRoot, path)
+}
+
+// openStateFile opens one of the files takeown keeps its state in, such as
+// USAGEFILE, creating it with the permissions and its directory if need
+// be, and locks it.  Closing the file releases the lock.  Since takeown
+// trusts what these files say, it refuses files that are not regular files
+// owned and only writable by the administrator, or by stateGroup.
+func openStateFile(path string, perm os.FileMode) (*os.File, error) {
+	if err := makeStateDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	flags := os.O_RDWR | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	f, err := os.OpenFile(path, flags|os.O_CREATE|os.O_EXCL, perm)
+	created := err == nil
+	if os.IsExist(err) {
+		f, err = os.OpenFile(path, flags, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if created && stateGroup >= 0 {
+		// The files takeown creates belong to whoever runs it, which
+		// with file capabilities is the calling user.  Only takeown
+		// can create files in a state directory, so those it created
+		// are given to the administrator, and opened up to
+		// stateGroup, so that runs by other users can open them too.
+		trace("giving %s to root and group %d", path, stateGroup)
+		if err := giveToStateGroup(f, perm); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := checkStateFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, NewError("lock", path, err)
+	}
+	return f, nil
+}
+
+// giveToStateGroup gives the file to the administrator and stateGroup, with
+// the permissions for both.
+func giveToStateGroup(f *os.File, perm os.FileMode) error {
+	if err := f.Chmod(perm | perm&0700>>3); err != nil {
+		return err
+	}
+	return f.Chown(0, stateGroup)
+}
+
+// makeStateDir creates the directory of state files if need be, and
+// refuses one that anyone but the administrator, or stateGroup, could write
+// to or search.  Installed with file capabilities, takeown cannot create
+// it, so the administrator does when installing takeown.
+func makeStateDir(dir string) error {
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err == nil && stateGroup >= 0 {
+		trace("giving %s to root and group %d", dir, stateGroup)
+		f, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		err = giveToStateGroup(f, 0700)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(dir, &st); err != nil {
+		return NewError("stat", dir, err)
+	}
+	if st.Uid != 0 || !onlyStateGroup(&st, 077) || st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return NewError("open", dir, fmt.Errorf("directory must be owned and only accessible by root%s", orStateGroup()))
+	}
+	return nil
+}
+
+// checkStateFile refuses the open file unless it is a regular file owned
+// and only writable by the administrator, or by stateGroup.
+func checkStateFile(f *os.File) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return NewError("stat", f.Name(), err)
+	}
+	if st.Uid != 0 || !onlyStateGroup(&st, 022) || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return NewError("open", f.Name(), fmt.Errorf("file must be a regular file owned and only writable by root%s", orStateGroup()))
+	}
+	return nil
+}
+
+// orStateGroup names stateGroup, if there is one, for error messages.
+func orStateGroup() string {
+	if stateGroup < 0 {
+		return ""
+	}
+	return fmt.Sprintf(" and group %d", stateGroup)
+}
+
+// onlyStateGroup returns true if the permissions in mask are granted to no
+// one but the owner of the file, and stateGroup if the file belongs to it.
+func onlyStateGroup(st *syscall.Stat_t, mask uint32) bool {
+	if st.Mode&mask&007 != 0 {
+		return false
+	}
+	return st.Mode&mask&070 == 0 || stateGroup >= 0 && int(st.Gid) == stateGroup
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/pkg/xattr"
 )
 
 type Privilege int
@@ -81,6 +89,12 @@ type TestingVM struct {
 	t                     *testing.T
 	unprivilegedUser      string
 	unprivilegedUid       uint32
+	// supplementaryGroup, if set, is added to the groups of the
+	// unprivileged user when running the program.
+	supplementaryGroup string
+	// shell, if set, is run by the shell as the unprivileged user just
+	// before the program, which then replaces the shell.
+	shell string
 }
 
 func That(criterion Criterion, comparator Comparator, value interface{}) Expectation {
@@ -124,8 +138,14 @@ func SucceedQuietly() []Expectation {
 	return []Expectation{Print(""), PrintErr(""), Succeed()}
 }
 
+func helpText() string {
+	var b bytes.Buffer
+	writeHelp(&b)
+	return b.String()
+}
+
 func ExitWithUsage() []Expectation {
-	return []Expectation{Print(""), PrintErr(USAGE), ExitWith(Usage)}
+	return []Expectation{Print(""), PrintErr(helpText()), ExitWith(Usage)}
 }
 
 func parseStatBits(s *StatInfo, bits ...uint32) {
@@ -305,7 +325,7 @@ func Instantiate(t *testing.T, unprivilegedUser string) (TestingVM, error) {
 	v.blockdevForTestData = g.Name()
 	v.mountpointForTestData = filepath.Join(tempdir, "takeown-data.dir")
 
-	if err = ccopy("takeown", filepath.Join(v.mountpointForProgram, "takeown")); err != nil {
+	if err = ccopy(testProgram, filepath.Join(v.mountpointForProgram, "takeown")); err != nil {
 		return v, err
 	}
 	if err = os.Lchown(filepath.Join(v.mountpointForProgram, "takeown"), 0, 0); err != nil {
@@ -397,10 +417,30 @@ func (t TestingVM) invoke(opts []string, paths []string, privilege Privilege) (s
 	args := append(opts, paths...)
 	var c *exec.Cmd
 	if privilege == Privileged {
-		c = exec.Command(t.takeownPath, args...)
+		if t.shell != "" {
+			c = exec.Command("sh", append([]string{"-c", t.shell + "\nexec \"$0\" \"$@\"", t.takeownPath}, args...)...)
+		} else {
+			c = exec.Command(t.takeownPath, args...)
+		}
 	} else {
+		runuser := []string{"-u", t.unprivilegedUser}
+		if t.supplementaryGroup != "" {
+			u, err := user.Lookup(t.unprivilegedUser)
+			if err != nil {
+				return "", "", 0, err
+			}
+			primary, err := user.LookupGroupId(u.Gid)
+			if err != nil {
+				return "", "", 0, err
+			}
+			runuser = append(runuser, "-g", primary.Name, "-G", t.supplementaryGroup)
+		}
+		runuser = append(runuser, "--")
+		if t.shell != "" {
+			runuser = append(runuser, "sh", "-c", t.shell+"\nexec \"$0\" \"$@\"")
+		}
 		c = exec.Command("runuser", append(
-			[]string{"-u", t.unprivilegedUser, "--", t.takeownPath},
+			append(runuser, t.takeownPath),
 			args...,
 		)...,
 		)
@@ -593,6 +633,53 @@ func init() {
 	}
 }
 
+// testProgram is the takeown the tests run.  It is built to keep its state
+// files under a directory of its own, so that the tests leave those of the
+// system alone, and the paths of the state files the tests look at are
+// moved there as well.
+var testProgram string
+
+func TestMain(m *testing.M) {
+	root, err := ioutil.TempDir("", "golang-takeown-state")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: cannot create directory for state files: %v\n", err)
+		os.Exit(16)
+	}
+	status := 16
+	if err := buildTestProgram(root); err != nil {
+		fmt.Fprintf(os.Stderr, "error: cannot build takeown to test: %v\n", err)
+	} else {
+		status = m.Run()
+	}
+	os.RemoveAll(root)
+	os.Exit(status)
+}
+
+func buildTestProgram(root string) error {
+	// Run with capabilities, takeown must reach the state directories
+	// as the calling user.
+	if err := os.Chmod(root, 0755); err != nil {
+		return err
+	}
+	for _, dir := range []string{"var/lib", "var/spool", "var/log"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	testProgram = filepath.Join(root, "takeown")
+	if err := runAndPrintErrors("go", "build", "-mod=vendor", "-ldflags", "-X main.stateRoot="+root, "-o", testProgram, "."); err != nil {
+		return err
+	}
+	stateRoot = root
+	for _, path := range []*string{&GRANTLOCK, &USAGEFILE, &SPOOLFILE, &AUDITFILE} {
+		*path = filepath.Join(root, *path)
+	}
+	for n := range stateDirs {
+		stateDirs[n] = filepath.Join(root, stateDirs[n])
+	}
+	return nil
+}
+
 func i(t *testing.T) TestingVM {
 	vm, err := Instantiate(t, "nobody")
 	if err != nil {
@@ -617,7 +704,7 @@ func TestIntegration(t *testing.T) {
 	v.Run("invoking program without arguments",
 		nil, nil,
 	).Must(
-		Print(""), PrintErr(USAGE), ExitWith(Usage),
+		ExitWithUsage()...,
 	)
 
 	v.Run("invoking program with tracing",
@@ -648,6 +735,23 @@ func TestIntegration(t *testing.T) {
 		ExitWithUsage()...,
 	)
 
+	for _, args := range [][]string{
+		{"-l", "-d", "root"},
+		{"-l", "-check"},
+		{"-explain", "-r"},
+		{"-release", "-to", "root"},
+		{"-reason", "needed"},
+		{"-d", "-once", "root"},
+		{"-pending", "-files-from", "list"},
+		{"-help", "-l"},
+	} {
+		v.Run("invoking program with flags of another action "+strings.Join(args, " "),
+			args, []string{"somefile"},
+		).Must(
+			ExitWithUsage()...,
+		)
+	}
+
 	v.Modify("creating some files",
 		D("somedirectory"),
 		F("somefile"),
@@ -685,8 +789,8 @@ func TestIntegration(t *testing.T) {
 		[]string{"-a", v.unprivilegedUser}, []string{"somefile2"}, Unprivileged,
 	).Must(
 		Print(""),
-		PrintErr("error adding delegation for user nobody on path somefile2: stat somefile2: not a directory"),
-		ExitWith(OperationError),
+		FinishErrWith("operation not permitted"),
+		ExitWith(PermissionDenied),
 	)
 
 	v.Run("grant delegation on somedirectory as nobody",
@@ -877,3 +981,2675 @@ func TestIntegration(t *testing.T) {
 
 	// FIXME add test cases for not showing putatively hidden directories if no permission is there and user not authorized
 }
+
+func TestModePolicy(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating incoming files",
+		D("incoming", 0, 0, 0755),
+		D("incoming/sub", 1000, 1000, 0777),
+		F("incoming/upload", 1000, 1000, 0600),
+		F("incoming/sub/upload2", 1000, 1000, 0777),
+	)
+
+	v.Run("grant delegation with invalid mode policy",
+		[]string{"-a", "-file-mode", "4755", v.unprivilegedUser}, []string{"incoming"},
+	).Must(
+		Print(""),
+		PrintErr("error: mode \"4755\" may not set bits outside of 1777"),
+		ExitWith(Usage),
+	)
+
+	v.Run("grant delegation with mode policy",
+		[]string{"-a", "-file-mode", "0644", "-dir-mode", "0755", v.unprivilegedUser}, []string{"incoming"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("simulate taking ownership under mode policy",
+		[]string{"-r", "-s"}, []string{"incoming"}, Unprivileged,
+	).Must(
+		Print("would take ownership of incoming\nwould take ownership of incoming/sub and set mode 0755\nwould take ownership of incoming/sub/upload2 and set mode 0644\nwould take ownership of incoming/upload and set mode 0644\nwould transfer 2048 bytes in 4 files"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("incoming/upload", 1000, 1000, 0600),
+	)
+
+	v.Run("take ownership under mode policy with stricter mode",
+		[]string{"-v", "-m", "0750"}, []string{"incoming/sub", "incoming/upload"}, Unprivileged,
+	).Must(
+		Print("took ownership of incoming/sub and set mode 0750\ntook ownership of incoming/upload and set mode 0640"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("incoming/sub", v.unprivilegedUid, 1000, 0750),
+		Stat("incoming/upload", v.unprivilegedUid, 1000, 0640),
+	)
+
+	v.Run("take ownership under mode policy",
+		nil, []string{"incoming/sub/upload2"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("incoming/sub/upload2", v.unprivilegedUid, 1000, 0644),
+	)
+}
+
+// InstallWithCapabilities removes the set-uid bit from the program, and
+// gives it the file capabilities in spec instead.
+// testStateGroup is the group takeown is set-gid to when installed with
+// file capabilities, and which its state directories belong to.
+const testStateGroup = 4500
+
+func (v *TestingVM) InstallWithCapabilities(spec string) {
+	if err := os.Lchown(v.takeownPath, 0, testStateGroup); err != nil {
+		v.t.Fatalf("cannot give %s to group %d: %v", v.takeownPath, testStateGroup, err)
+	}
+	if err := os.Chmod(v.takeownPath, 0755|os.ModeSetgid); err != nil {
+		v.t.Fatalf("cannot replace set-uid bit of %s with set-gid bit: %v", v.takeownPath, err)
+	}
+	if err := runAndPrintErrors("setcap", spec, v.takeownPath); err != nil {
+		v.t.Fatalf("cannot set capabilities %s on %s: %v", spec, v.takeownPath, err)
+	}
+}
+
+// SetACL sets an ACL attribute on a file in the test data directory.
+func (v *TestingVM) SetACL(path string, attr string, a acl) {
+	fullpath, assertion := v.assertPathWithinTestData(path)
+	if assertion != nil {
+		v.t.Fatalf("while %s: %v", v.lastDescription, assertion)
+	}
+	if err := xattr.LSet(fullpath, attr, a.bytes()); err != nil {
+		v.t.Fatalf("while %s: cannot set %s on %q: %v", v.lastDescription, attr, path, err)
+	}
+}
+
+// CheckACL checks that the ACL attribute of a file matches.  A nil ACL
+// expects the attribute to be absent.
+func (v *TestingVM) CheckACL(path string, attr string, expected acl) {
+	fullpath, assertion := v.assertPathWithinTestData(path)
+	if assertion != nil {
+		v.t.Fatalf("after %s: %v", v.lastDescription, assertion)
+	}
+	data, err := lgetxattr(fullpath, attr)
+	if err != nil {
+		v.t.Fatalf("after %s: cannot get %s of %q: %v", v.lastDescription, attr, path, err)
+	}
+	if expected == nil {
+		if data != nil {
+			v.t.Errorf("after %s: %s of %q, expected none, got %v", v.lastDescription, attr, path, *data)
+		}
+		return
+	}
+	if data == nil {
+		v.t.Errorf("after %s: %s of %q, expected %v, got none", v.lastDescription, attr, path, expected)
+		return
+	}
+	got, err := parseACL(*data)
+	if err != nil {
+		v.t.Fatalf("after %s: cannot parse %s of %q: %v", v.lastDescription, attr, path, err)
+	}
+	if !bytes.Equal(got.bytes(), expected.bytes()) {
+		v.t.Errorf("after %s: %s of %q, expected %v, got %v", v.lastDescription, attr, path, expected, got)
+	}
+}
+
+func TestACLPolicy(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating shared files",
+		D("shared", 0, 0, 0755),
+		D("shared/inherit", 0, 0, 0755),
+		F("shared/report", 1000, 1000, 0660),
+		F("shared/inherit/report", 1000, 1000, 0660),
+		D("shared/drop", 1000, 1000, 0755),
+	)
+	v.SetACL("shared/report", ACCESSACL, acl{
+		{aclUserObj, 6, aclUndefinedID},
+		{aclUser, 6, 1000},
+		{aclUser, 4, 1001},
+		{aclGroupObj, 6, aclUndefinedID},
+		{aclMask, 6, aclUndefinedID},
+		{aclOther, 0, aclUndefinedID},
+	})
+	v.SetACL("shared/drop", DEFAULTACL, acl{
+		{aclUserObj, 7, aclUndefinedID},
+		{aclUser, 7, 1001},
+		{aclGroupObj, 5, aclUndefinedID},
+		{aclMask, 7, aclUndefinedID},
+		{aclOther, 0, aclUndefinedID},
+	})
+	v.SetACL("shared/inherit", DEFAULTACL, acl{
+		{aclUserObj, 7, aclUndefinedID},
+		{aclUser, 5, 1002},
+		{aclGroupObj, 5, aclUndefinedID},
+		{aclMask, 5, aclUndefinedID},
+		{aclOther, 0, aclUndefinedID},
+	})
+
+	v.Run("grant delegation with invalid ACL policy",
+		[]string{"-a", "-acl", "nuke", v.unprivilegedUser}, []string{"shared"},
+	).Must(
+		Print(""),
+		PrintErr("error: invalid ACL policy \"nuke\" (valid policies are strip, rewrite and inherit)"),
+		ExitWith(Usage),
+	)
+
+	v.Run("grant delegation with ACL rewrite policy",
+		[]string{"-a", "-acl", "rewrite", v.unprivilegedUser}, []string{"shared"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("simulate taking ownership under ACL rewrite policy",
+		[]string{"-s"}, []string{"shared/report"}, Unprivileged,
+	).Must(
+		Print("would take ownership of shared/report and rewrite ACL entries of previous owner\nwould transfer 0 bytes in 1 file"),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("grant delegation with ACL strip policy",
+		[]string{"-a", "-acl", "strip", v.unprivilegedUser}, []string{"shared"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("take ownership under ACL strip policy",
+		[]string{"-v"}, []string{"shared/report"}, Unprivileged,
+	).Must(
+		Print("took ownership of shared/report and strip named user ACL entries"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("shared/report", v.unprivilegedUid, 1000, 0660),
+	)
+	v.CheckACL("shared/report", ACCESSACL, nil)
+
+	v.Run("take ownership of a directory under ACL strip policy",
+		[]string{"-v"}, []string{"shared/drop"}, Unprivileged,
+	).Must(
+		Print("took ownership of shared/drop and strip named user ACL entries"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("shared/drop", v.unprivilegedUid, 1000, 0755),
+	)
+	v.CheckACL("shared/drop", DEFAULTACL, acl{
+		{aclUserObj, 7, aclUndefinedID},
+		{aclGroupObj, 5, aclUndefinedID},
+		{aclOther, 0, aclUndefinedID},
+	})
+
+	v.Run("grant delegation with ACL inherit policy",
+		[]string{"-a", "-acl", "inherit", v.unprivilegedUser}, []string{"shared/inherit"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("take ownership under ACL inherit policy",
+		[]string{"-v"}, []string{"shared/inherit/report"}, Unprivileged,
+	).Must(
+		Print("took ownership of shared/inherit/report and apply default ACL of parent directory"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("shared/inherit/report", v.unprivilegedUid, 1000, 0640),
+	)
+	v.CheckACL("shared/inherit/report", ACCESSACL, acl{
+		{aclUserObj, 6, aclUndefinedID},
+		{aclUser, 5, 1002},
+		{aclGroupObj, 5, aclUndefinedID},
+		{aclMask, 4, aclUndefinedID},
+		{aclOther, 0, aclUndefinedID},
+	})
+}
+
+func TestGiveAway(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating intake files",
+		D("intake", 0, 0, 0755),
+		F("intake/scan", 1000, 1000, 0644),
+	)
+
+	v.Run("grant delegation to the team member",
+		[]string{"-a", "-file-mode", "0600", "2000"}, []string{"intake"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("give away ownership without dispatch right",
+		[]string{"-to", "2000"}, []string{"intake/scan"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error giving ownership of intake/scan to 2000: permission denied"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.Run("grant dispatch delegation to the coordinator",
+		[]string{"-a", "-dispatch", v.unprivilegedUser}, []string{"intake"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("simulate giving away ownership",
+		[]string{"-s", "-to", "2000"}, []string{"intake/scan"}, Unprivileged,
+	).Must(
+		Print("would give ownership of intake/scan to 2000 and set mode 0600\nwould transfer 0 bytes in 1 file"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("intake/scan", 1000, 1000, 0644),
+	)
+
+	v.Run("give away ownership with dispatch right",
+		[]string{"-v", "-to", "2000"}, []string{"intake/scan"}, Unprivileged,
+	).Must(
+		Print("gave ownership of intake/scan to 2000 and set mode 0600"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("intake/scan", 2000, 1000, 0600),
+	)
+
+	v.Run("give away ownership of already given file",
+		[]string{"-v", "-to", "2000"}, []string{"intake/scan"}, Unprivileged,
+	).Must(
+		Print("file intake/scan already owned by 2000"),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("give away ownership to user without delegation",
+		[]string{"-to", "2001"}, []string{"intake/scan"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error giving ownership of intake/scan to 2001: target user holds no delegation covering the file"),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("intake/scan", 2000, 1000, 0600),
+	)
+
+	// The delegation of the receiving user restricts what it may be given
+	// as it restricts what the user may take.
+	v.Modify("creating files owned by others",
+		F("intake/other", 4000, 4000, 0644),
+		F("intake/first", 3000, 3000, 0644),
+		F("intake/second", 3000, 3000, 0644),
+	)
+	v.Run("grant restricted delegation to another team member",
+		[]string{"-a", "-owners", "3000", "-max-files", "1", "2002"}, []string{"intake"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("give away ownership of a file the target user may not take",
+		[]string{"-to", "2002"}, []string{"intake/other"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error giving ownership of intake/other to 2002: delegation of the target user does not cover files owned by 4000"),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("intake/other", 4000, 4000, 0644),
+	)
+
+	v.Run("give away more files than the target user may take",
+		[]string{"-to", "2002"}, []string{"intake/first", "intake/second"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error: giving ownership of 2 files under the delegation on %s would exceed its limit of 1 file per run", filepath.Join(v.Datadir(), "intake")),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("intake/first", 3000, 3000, 0644),
+		Stat("intake/second", 3000, 3000, 0644),
+	)
+
+	v.Run("give away as many files as the target user may take",
+		[]string{"-to", "2002"}, []string{"intake/first"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("intake/first", 2002, 3000, 0644),
+	)
+}
+
+func TestRelease(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating shared files",
+		D("dropbox", 3000, 3000, 0755),
+		D("dropbox/sub", 3000, 3000, 0755),
+		F("dropbox/sub/mistake", 3000, 3000, 0644),
+		F("dropbox/other", 3001, 3001, 0644),
+	)
+
+	v.Run("grant delegation without release",
+		[]string{"-a", v.unprivilegedUser}, []string{"dropbox"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("take ownership by mistake",
+		[]string{"-r"}, []string{"dropbox/sub"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("dropbox/sub/mistake", v.unprivilegedUid),
+	)
+
+	v.Run("release ownership without permission",
+		[]string{"-release"}, []string{"dropbox/sub/mistake"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error releasing ownership of dropbox/sub/mistake: permission denied"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.Run("grant delegation with release",
+		[]string{"-a", "-allow-release", v.unprivilegedUser}, []string{"dropbox"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("simulate release of ownership",
+		[]string{"-release", "-r", "-s"}, []string{"dropbox"}, Unprivileged,
+	).Must(
+		Print("would release ownership of dropbox/sub to 3000\nwould release ownership of dropbox/sub/mistake to 3000\nwould transfer 1024 bytes in 2 files"),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("release ownership",
+		[]string{"-release", "-r", "-v"}, []string{"dropbox"}, Unprivileged,
+	).Must(
+		Print("file dropbox already owned by 3000\nfile dropbox/other not owned, skipping\nreleased ownership of dropbox/sub to 3000\nreleased ownership of dropbox/sub/mistake to 3000"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("dropbox/sub", 3000),
+		Stat("dropbox/sub/mistake", 3000),
+		Stat("dropbox/other", 3001),
+	)
+
+	v.Run("grant delegation with home account",
+		[]string{"-a", "-home", "3002", v.unprivilegedUser}, []string{"dropbox"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("take ownership again",
+		nil, []string{"dropbox/sub/mistake"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("release ownership to home account",
+		[]string{"-release", "-v"}, []string{"dropbox/sub/mistake"}, Unprivileged,
+	).Must(
+		Print("released ownership of dropbox/sub/mistake to 3002"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("dropbox/sub/mistake", 3002),
+	)
+}
+
+func TestOwnerRestrictions(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating files of several owners",
+		D("ftp", 0, 0, 0755),
+		F("ftp/upload", 4000, 4000, 0644),
+		F("ftp/service", 60500, 60500, 0644),
+		F("ftp/rootfile", 0, 0, 0644),
+	)
+
+	v.Run("grant delegation with invalid owner restriction",
+		[]string{"-a", "-owners", "4000,nosuchuser", v.unprivilegedUser}, []string{"ftp"},
+	).Must(
+		Print(""),
+		PrintErr("error determining UID for user nosuchuser: user name has no corresponding UID"),
+		ExitWith(OperationError),
+	)
+
+	v.Run("grant delegation with owner restriction",
+		[]string{"-a", "-owners", "4000,60000-65000", v.unprivilegedUser}, []string{"ftp"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("take ownership of file owned by root",
+		nil, []string{"ftp/rootfile"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error taking ownership of ftp/rootfile: delegation does not cover files owned by root"),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("ftp/rootfile", 0),
+	)
+
+	v.Run("take ownership of files owned by allowed owners",
+		[]string{"-v"}, []string{"ftp/upload", "ftp/service"}, Unprivileged,
+	).Must(
+		Print("took ownership of ftp/upload\ntook ownership of ftp/service"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("ftp/upload", v.unprivilegedUid),
+		Stat("ftp/service", v.unprivilegedUid),
+	)
+}
+
+func TestPathPatterns(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating instrument output",
+		D("lab", 0, 0, 0755),
+		D("lab/scans", 0, 0, 0755),
+		F("lab/scans/image.tif", 0, 0, 0644),
+		F("lab/run.raw", 0, 0, 0644),
+		F("lab/signing.key", 0, 0, 0600),
+		F("lab/notes.txt", 0, 0, 0644),
+	)
+
+	v.Run("grant delegation with invalid pattern",
+		[]string{"-a", "-include", "[", v.unprivilegedUser}, []string{"lab"},
+	).Must(
+		Print(""),
+		PrintErr("error: invalid pattern \"[\": syntax error in pattern"),
+		ExitWith(Usage),
+	)
+
+	v.Run("grant delegation with patterns",
+		[]string{"-a", "-include", "*.raw", "-include", "scans/**", "-exclude", "*.key", v.unprivilegedUser}, []string{"lab"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list delegations with patterns",
+		[]string{"-l"}, []string{"lab"},
+	).Must(
+		Print("lab:\n\tnobody: via %s/lab (include *.raw scans/**; exclude *.key)", v.Datadir()),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("explain delegations of excluded file",
+		[]string{"-explain"}, []string{"lab/signing.key"}, Unprivileged,
+	).Must(
+		Print("lab/signing.key:\n\tnobody: via %s/lab (include *.raw scans/**; exclude *.key): excluded by pattern *.key", v.Datadir()),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("explain delegations of included file",
+		[]string{"-explain"}, []string{"lab/scans/image.tif"}, Unprivileged,
+	).Must(
+		Print("lab/scans/image.tif:\n\tnobody: via %s/lab (include *.raw scans/**; exclude *.key): included by pattern scans/**, applies", v.Datadir()),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("take ownership of files within and without the patterns",
+		[]string{"-r", "-v"}, []string{"lab"}, Unprivileged,
+	).Must(
+		Print("took ownership of lab/run.raw\ntook ownership of lab/scans\ntook ownership of lab/scans/image.tif"),
+		PrintErr("error taking ownership of lab: permission denied\nerror taking ownership of lab/notes.txt: permission denied\nerror taking ownership of lab/signing.key: permission denied"),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("lab/run.raw", v.unprivilegedUid),
+		Stat("lab/scans/image.tif", v.unprivilegedUid),
+		Stat("lab/signing.key", 0),
+		Stat("lab/notes.txt", 0),
+	)
+}
+
+func TestFileGrants(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating datasets",
+		D("datasets", 0, 0, 0755),
+		F("datasets/big.h5", 0, 0, 0644),
+		F("datasets/sibling.h5", 0, 0, 0644),
+	)
+
+	v.Run("grant delegation with patterns on a file",
+		[]string{"-a", "-include", "*.h5", v.unprivilegedUser}, []string{"datasets/big.h5"},
+	).Must(
+		Print(""),
+		PrintErr("error adding delegation for user nobody on path datasets/big.h5: add grant %s/datasets/big.h5: grants on files cannot carry path patterns", v.mountpointForTestData),
+		ExitWith(OperationError),
+	)
+
+	v.Run("grant delegation on a file",
+		[]string{"-a", v.unprivilegedUser}, []string{"datasets/big.h5"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("grant delegation on the directory of the file",
+		[]string{"-a", "-dispatch", "5000"}, []string{"datasets"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list delegations on the file",
+		[]string{"-l"}, []string{"datasets/big.h5"},
+	).Must(
+		Print("datasets/big.h5:\n\t5000: via %s/datasets (dispatch)\n\tnobody: via file %s/datasets/big.h5", v.Datadir(), v.Datadir()),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("take ownership of the delegated file and its sibling",
+		[]string{"-v"}, []string{"datasets/big.h5", "datasets/sibling.h5"}, Unprivileged,
+	).Must(
+		Print("took ownership of datasets/big.h5"),
+		PrintErr("error taking ownership of datasets/sibling.h5: permission denied"),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("datasets/big.h5", v.unprivilegedUid),
+		Stat("datasets/sibling.h5", 0),
+	)
+
+	v.Run("remove delegation on a file",
+		[]string{"-d", v.unprivilegedUser}, []string{"datasets/big.h5"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list delegations on the file after removal",
+		[]string{"-l"}, []string{"datasets/big.h5"},
+	).Must(
+		Print("datasets/big.h5:\n\t5000: via %s/datasets (dispatch)", v.Datadir()),
+		PrintErr(""),
+		Succeed(),
+	)
+}
+
+func TestQuota(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a large tree",
+		D("big", 0, 0, 0755),
+		D("big/data", 0, 0, 0755),
+		F("big/data/a", 0, 0, 0644),
+		F("big/data/b", 0, 0, 0644),
+	)
+	fullpath := filepath.Join(v.Datadir(), "big/data/a")
+	if err := ioutil.WriteFile(fullpath, make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("cannot write %s: %v", fullpath, err)
+	}
+	if err := os.Link(fullpath, filepath.Join(v.Datadir(), "big/a-link")); err != nil {
+		t.Fatalf("cannot link %s: %v", fullpath, err)
+	}
+
+	v.Run("grant delegation on the tree",
+		[]string{"-a", v.unprivilegedUser}, []string{"big"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("simulate taking ownership of the tree",
+		[]string{"-r", "-s"}, []string{"big"}, Unprivileged,
+	).Must(
+		Print("would take ownership of big\nwould take ownership of big/a-link\nwould take ownership of big/data\nwould take ownership of big/data/a\nwould take ownership of big/data/b\nwould transfer 6144 bytes in 4 files"),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("ignore quota as unprivileged user",
+		[]string{"-r", "-ignore-quota"}, []string{"big"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error: only the administrator may ignore disk quotas"),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("big/data/a", 0),
+	)
+
+	v.Run("take ownership of the tree ignoring quota as root",
+		[]string{"-r", "-ignore-quota"}, []string{"big"},
+	).Must(
+		SucceedQuietly()...,
+	)
+}
+
+func TestLimits(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating files to rescue",
+		D("rescue", 0, 0, 0755),
+		F("rescue/a", 0, 0, 0644),
+		F("rescue/b", 0, 0, 0644),
+		F("rescue/c", 0, 0, 0644),
+		F("rescue/d", 0, 0, 0644),
+		D("large", 0, 0, 0755),
+		F("large/a", 0, 0, 0644),
+	)
+	fullpath := filepath.Join(v.Datadir(), "large/a")
+	if err := ioutil.WriteFile(fullpath, make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("cannot write %s: %v", fullpath, err)
+	}
+	rescue := filepath.Join(v.Datadir(), "rescue")
+	large := filepath.Join(v.Datadir(), "large")
+
+	v.Run("grant delegation with invalid limit",
+		[]string{"-a", "-max-bytes", "lots", v.unprivilegedUser}, []string{"rescue"},
+	).Must(
+		Print(""),
+		PrintErr(`error: invalid byte limit "lots"`),
+		ExitWith(Usage),
+	)
+
+	v.Run("grant delegation with file limits",
+		[]string{"-a", "-max-files", "2", "-max-daily-files", "3", v.unprivilegedUser}, []string{"rescue"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("grant delegation with byte limit",
+		[]string{"-a", "-max-bytes", "1K", v.unprivilegedUser}, []string{"large"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list delegations with limits",
+		[]string{"-l"}, []string{"rescue", "large"},
+	).Must(
+		Print(fmt.Sprintf("rescue:\n\t%s: via %s (limit 2 files per run, 3 files per day)\nlarge:\n\t%s: via %s (limit 1024 bytes per run)", v.unprivilegedUser, rescue, v.unprivilegedUser, large)),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("take more files than allowed per run",
+		nil, []string{"rescue/a", "rescue/b", "rescue/c"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr(fmt.Sprintf("error: taking ownership of 3 files under the delegation on %s would exceed its limit of 2 files per run", rescue)),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("rescue/a", 0),
+	)
+
+	v.Run("take more bytes than allowed per run",
+		nil, []string{"large/a"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr(fmt.Sprintf("error: taking ownership of 4096 bytes under the delegation on %s would exceed its limit of 1024 bytes per run", large)),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("large/a", 0),
+	)
+
+	v.Run("take files within the limits",
+		nil, []string{"rescue/a", "rescue/b"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("rescue/a", v.unprivilegedUid),
+		Stat("rescue/b", v.unprivilegedUid),
+	)
+
+	v.Run("take more files than allowed per day",
+		nil, []string{"rescue/c", "rescue/d"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr(fmt.Sprintf("error: taking ownership of 2 files under the delegation on %s would exceed its limit of 3 files per day (2 already used today)", rescue)),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("rescue/c", 0),
+	)
+
+	v.Run("take the last file allowed today",
+		nil, []string{"rescue/c"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("rescue/c", v.unprivilegedUid),
+	)
+
+	// Only the usage file of the tests is made writable by others than
+	// root, and never by everyone.
+	if err := os.Chmod(USAGEFILE, 0620); err != nil {
+		t.Fatal(err)
+	}
+	v.Run("take files with a usage file its group may write",
+		nil, []string{"rescue/d"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error checking delegation limits: open %s: file must be a regular file owned and only writable by root", USAGEFILE),
+		ExitWith(OperationError),
+	).Causes(
+		Stat("rescue/d", 0),
+	)
+	if err := os.Chmod(USAGEFILE, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v.Run("give files beyond the limits away as root",
+		[]string{"-to", v.unprivilegedUser}, []string{"rescue/d", "large/a"},
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("rescue/d", v.unprivilegedUid),
+		Stat("large/a", v.unprivilegedUid),
+	)
+
+	// Files under delegations without limits are changed right away, and
+	// the run only starts over, totalling the rest first, once it gets to
+	// a delegation with limits.
+	for _, c := range []struct {
+		tree  string
+		limit string
+	}{{"over", "2"}, {"within", "3"}} {
+		v.Modify("creating a tree with limits beneath "+c.tree,
+			D(c.tree, 0, 0, 0755),
+			F(c.tree+"/a", 0, 0, 0644),
+			D(c.tree+"/nested", 0, 0, 0755),
+			F(c.tree+"/nested/x", 0, 0, 0644),
+			F(c.tree+"/nested/y", 0, 0, 0644),
+			F(c.tree+"/z", 0, 0, 0644),
+		)
+		v.Run("grant delegation without limits on "+c.tree,
+			[]string{"-a", v.unprivilegedUser}, []string{c.tree},
+		).Must(
+			SucceedQuietly()...,
+		)
+		v.Run("grant delegation with limits beneath "+c.tree,
+			[]string{"-a", "-max-files", c.limit, v.unprivilegedUser}, []string{c.tree + "/nested"},
+		).Must(
+			SucceedQuietly()...,
+		)
+	}
+	over := filepath.Join(v.Datadir(), "over")
+	v.Run("take a tree holding more files than a delegation beneath allows",
+		[]string{"-r", "-v"}, []string{"over"}, Unprivileged,
+	).Must(
+		Print("took ownership of over\ntook ownership of over/a"),
+		PrintErr(fmt.Sprintf("error: taking ownership of 3 files under the delegation on %s/nested would exceed its limit of 2 files per run", over)),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("over/a", v.unprivilegedUid),
+		Stat("over/nested", 0),
+		Stat("over/nested/x", 0),
+		Stat("over/z", 0),
+	)
+	v.Run("take a tree holding as many files as a delegation beneath allows",
+		[]string{"-r", "-v"}, []string{"within"}, Unprivileged,
+	).Must(
+		Print("took ownership of within\ntook ownership of within/a\ntook ownership of within/nested\ntook ownership of within/nested/x\ntook ownership of within/nested/y\ntook ownership of within/z"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("within/nested/y", v.unprivilegedUid),
+		Stat("within/z", v.unprivilegedUid),
+	)
+}
+
+func TestOnceGrants(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	if _, err := os.Stat(AUDITFILE); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(AUDITFILE), 0755); err != nil {
+			t.Fatalf("cannot create directory of %s: %v", AUDITFILE, err)
+		}
+		if err := ioutil.WriteFile(AUDITFILE, nil, 0600); err != nil {
+			t.Fatalf("cannot create %s: %v", AUDITFILE, err)
+		}
+		defer os.Remove(AUDITFILE)
+	}
+	before, err := os.Stat(AUDITFILE)
+	if err != nil {
+		t.Fatalf("cannot stat %s: %v", AUDITFILE, err)
+	}
+
+	v.Modify("creating files to rescue",
+		D("stuck", 0, 0, 0755),
+		F("stuck/file", 0, 0, 0644),
+		D("incident", 0, 0, 0755),
+	)
+	const racers = 8
+	for n := 0; n < racers; n++ {
+		v.Modify("creating files to race for", F(fmt.Sprintf("incident/%d", n), 0, 0, 0644))
+	}
+	stuck := filepath.Join(v.Datadir(), "stuck/file")
+	incident := filepath.Join(v.Datadir(), "incident")
+
+	v.Run("grant one-shot delegations",
+		[]string{"-a", "--once", v.unprivilegedUser}, []string{"stuck/file", "incident"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list one-shot delegations",
+		[]string{"-l"}, []string{"stuck/file"},
+	).Must(
+		Print(fmt.Sprintf("stuck/file:\n\t%s: via file %s (once)", v.unprivilegedUser, stuck)),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("take more than one file under a one-shot delegation",
+		[]string{"-r"}, []string{"incident"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr(fmt.Sprintf("error: taking ownership of %d files under the delegation on %s would exceed its limit of 1 file, as it may only be used once", racers+1, incident)),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("incident", 0),
+	)
+
+	v.Run("take ownership under a one-shot delegation",
+		nil, []string{"stuck/file"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("stuck/file", v.unprivilegedUid),
+	)
+
+	v.Modify("handing the file back to root",
+		F("stuck/file", 0, 0, 0644),
+	)
+
+	v.Run("take ownership again under the used delegation",
+		nil, []string{"stuck/file"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error taking ownership of stuck/file: permission denied"),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("stuck/file", 0),
+	)
+
+	// Runs racing for the same one-shot delegation must not both use it.
+	exits := make(chan int, racers)
+	for n := 0; n < racers; n++ {
+		go func(n int) {
+			_, _, exit, malfunction := v.invoke(nil, []string{fmt.Sprintf("incident/%d", n)}, Unprivileged)
+			if malfunction != nil {
+				t.Errorf("malfunction invoking takeown: %v", malfunction)
+			}
+			exits <- exit
+		}(n)
+	}
+	taken := 0
+	for n := 0; n < racers; n++ {
+		switch exit := <-exits; exit {
+		case Success:
+			taken++
+		case PermissionDenied:
+		default:
+			t.Errorf("racing for a one-shot delegation: unexpected exit status %d", exit)
+		}
+	}
+	owned := 0
+	for n := 0; n < racers; n++ {
+		st, err := os.Lstat(filepath.Join(incident, fmt.Sprintf("%d", n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Sys().(*syscall.Stat_t).Uid == v.unprivilegedUid {
+			owned++
+		}
+	}
+	if taken != 1 || owned != 1 {
+		t.Errorf("racing for a one-shot delegation: expected 1 file taken, got %d runs succeeding and %d files taken", taken, owned)
+	}
+
+	data, err := ioutil.ReadFile(AUDITFILE)
+	if err != nil {
+		t.Fatalf("cannot read %s: %v", AUDITFILE, err)
+	}
+	consumed := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data[before.Size():])), "\n") {
+		var e AuditEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("malformed audit event %q: %v", line, err)
+		}
+		if e.Action == auditConsume {
+			if e.Delegation == nil || !e.Delegation.Grant.Once {
+				t.Errorf("audit event of consumption lacks the one-shot delegation: %+v", e)
+			}
+			consumed = append(consumed, e.Path)
+		}
+	}
+	if len(consumed) != 2 || consumed[0] != stuck || filepath.Dir(consumed[1]) != incident {
+		t.Errorf("expected consumption of the delegations on %s and %s to be audited, got %q", stuck, incident, consumed)
+	}
+}
+
+func TestTimeWindows(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating drop directories",
+		D("day", 0, 0, 0755),
+		F("day/file", 0, 0, 0644),
+		D("night", 0, 0, 0755),
+		F("night/file", 0, 0, 0644),
+	)
+
+	// The open window spans today and tomorrow, so it stays open should
+	// the test run past midnight, and the closed window runs overnight
+	// from the day after tomorrow, so it stays closed.
+	today := time.Now().UTC().Weekday()
+	open, err := ParseTimeWindow(fmt.Sprintf("%s,%s 00:00-24:00", dayNames[today], dayNames[(today+1)%7]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, err := ParseTimeWindow(fmt.Sprintf("%s 22:00-06:00", dayNames[(today+2)%7]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := ParseTimeWindow(fmt.Sprintf("%s 12:00-13:00", dayNames[(today+4)%7]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.Run("grant delegation with invalid time zone",
+		[]string{"-a", "-window", "09:00-17:00", "-timezone", "Mars/Olympus", v.unprivilegedUser}, []string{"day"},
+	).Must(
+		Print(""),
+		PrintErr(`error: invalid time zone "Mars/Olympus"`),
+		ExitWith(Usage),
+	)
+
+	v.Run("grant delegation with invalid time window",
+		[]string{"grant", "--window", "Mon-Fry 22:00-06:00", v.unprivilegedUser, "day"}, nil,
+	).Must(
+		Print(""),
+		PrintErr("takeown grant: invalid value \"Mon-Fry 22:00-06:00\" for flag -window: invalid time window \"Mon-Fry 22:00-06:00\"\nTry 'takeown grant --help' for more information."),
+		ExitWith(Usage),
+	)
+
+	v.Run("grant delegation within its time window",
+		[]string{"-a", "-window", open.String(), "-timezone", "UTC", v.unprivilegedUser}, []string{"day"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("grant delegation outside its time window",
+		[]string{"-a", "-window", closed.String(), "-window", later.String(), "-timezone", "UTC", v.unprivilegedUser}, []string{"night"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list delegations with time windows",
+		[]string{"-l"}, []string{"day", "night"},
+	).Must(
+		Print("day:\n\tnobody: via %s/day (window %s UTC)\nnight:\n\tnobody: via %s/night (window %s, %s UTC)", v.Datadir(), open, v.Datadir(), closed, later),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("explain delegation within its time window",
+		[]string{"-explain"}, []string{"day/file"}, Unprivileged,
+	).Must(
+		Print("day/file:\n\tnobody: via %s/day (window %s UTC): covered, within window %s, applies", v.Datadir(), open, open),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	r := v.Run("explain delegation outside its time window",
+		[]string{"-explain"}, []string{"night/file"}, Unprivileged,
+	)
+	r.Must(
+		PrintErr(""),
+		Succeed(),
+	)
+	expected := fmt.Sprintf("night/file:\n\tnobody: via %s/night (window %s, %s UTC): covered, but outside window %s, %s UTC (now ", v.Datadir(), closed, later, closed, later)
+	if !strings.HasPrefix(r.out, expected) {
+		t.Errorf("while explaining delegation outside its time window: got stdout %q, expected it to start with %q", r.out, expected)
+	}
+
+	v.Run("take ownership within the time window",
+		nil, []string{"day/file"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("day/file", v.unprivilegedUid),
+	)
+
+	v.Run("take ownership outside the time window",
+		nil, []string{"night/file"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error taking ownership of night/file: permission denied"),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("night/file", 0),
+	)
+}
+
+func TestConcurrentGrantChanges(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a shared directory",
+		D("shared", 0, 0, 0755),
+	)
+	shared := filepath.Join(v.Datadir(), "shared")
+
+	// Each run changes the grant of a different user, so every change
+	// must survive the others.
+	const runs = 16
+	hammer := func(desc string, opts func(n int) []string) {
+		failures := make(chan string, runs)
+		for n := 0; n < runs; n++ {
+			go func(n int) {
+				_, stderr, exit, malfunction := v.invoke(opts(n), []string{"shared"}, Privileged)
+				if malfunction != nil || exit != Success {
+					failures <- fmt.Sprintf("%v %d %s", malfunction, exit, stderr)
+					return
+				}
+				failures <- ""
+			}(n)
+		}
+		for n := 0; n < runs; n++ {
+			if f := <-failures; f != "" {
+				t.Errorf("while %s: run failed: %s", desc, f)
+			}
+		}
+	}
+	check := func(desc string, expected UIDList) {
+		u := GrantList{}
+		if err := UnmarshalFromXattr(shared, ATTRNAME, &u); err != nil {
+			t.Fatalf("while %s: cannot read grants: %v", desc, err)
+		}
+		got := u.UIDs()
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("while %s: expected grants for %v, got %v", desc, expected, got)
+		}
+	}
+
+	hammer("adding delegations concurrently", func(n int) []string {
+		return []string{"-a", fmt.Sprintf("%d", 6000+n)}
+	})
+	expected := UIDList{}
+	for n := 0; n < runs; n++ {
+		expected = append(expected, UID(6000+n))
+	}
+	check("adding delegations concurrently", expected)
+
+	hammer("adding and removing delegations concurrently", func(n int) []string {
+		if n%2 == 0 {
+			return []string{"-d", fmt.Sprintf("%d", 6000+n)}
+		}
+		return []string{"-a", fmt.Sprintf("%d", 7000+n)}
+	})
+	expected = UIDList{}
+	for n := 1; n < runs; n += 2 {
+		expected = append(expected, UID(6000+n))
+	}
+	for n := 1; n < runs; n += 2 {
+		expected = append(expected, UID(7000+n))
+	}
+	check("adding and removing delegations concurrently", expected)
+
+	// Only the lock file of the tests is made writable by others than
+	// root, and never by everyone.
+	if err := os.Chmod(GRANTLOCK, 0620); err != nil {
+		t.Fatal(err)
+	}
+	v.Run("add a delegation with a lock file its group may write",
+		[]string{"-a", "8000"}, []string{"shared"},
+	).Must(
+		Print(""),
+		PrintErr("error adding delegation for user 8000 on path shared: open %s: file must be a regular file owned and only writable by root", GRANTLOCK),
+		ExitWith(OperationError),
+	)
+	if err := os.Chmod(GRANTLOCK, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifests(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a project",
+		D("project", 0, 0, 0755),
+		D("project/drop", 0, 0, 0755),
+		F("project/frozen", 0, 0, 0644),
+		D("project/hidden", 0, 0, 0700),
+		F("project/hidden/file", 0, 0, 0644),
+	)
+	project := filepath.Join(v.Datadir(), "project")
+	write := func(name string, manifest string) {
+		if err := ioutil.WriteFile(filepath.Join(v.Datadir(), name), []byte(manifest), 0644); err != nil {
+			t.Fatalf("cannot write manifest %s: %v", name, err)
+		}
+	}
+
+	v.Run("grant delegations to be revoked and changed",
+		[]string{"-a", "daemon"}, []string{"project"},
+	).Must(
+		SucceedQuietly()...,
+	)
+	v.Run("grant one-shot delegation to be changed",
+		[]string{"-a", "-once", v.unprivilegedUser}, []string{"project/drop"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	write("bad.yaml", "paths:\n  /srv:\n      - users: nobody\n    - users: daemon\n")
+	v.Run("apply a malformed manifest",
+		[]string{"-apply", "bad.yaml"}, nil,
+	).Must(
+		Print(""),
+		PrintErr("error in manifest bad.yaml: line 3: did not find expected key"),
+		ExitWith(Usage),
+	)
+
+	write("aliases.yaml", "aliases:\n  operators: [nobody]\npaths: {}\n")
+	v.Run("apply a manifest with an unknown key",
+		[]string{"-apply", "aliases.yaml"}, nil,
+	).Must(
+		Print(""),
+		PrintErr(`error in manifest aliases.yaml: unknown key "aliases"`),
+		ExitWith(Usage),
+	)
+
+	write("manifest.yaml", fmt.Sprintf(`# Delegations of the project
+groups:
+  operators: [nobody, daemon]
+scopes:
+  nightly:
+    window: "Mon-Fri 22:00-06:00"   # the night shift
+    timezone: UTC
+    include: ["*.raw", scans/**]
+paths:
+  %s:
+    - groups: [operators]
+      scope: nightly
+      max-files: 10
+  %s/drop:
+    - users: nobody
+      dispatch: true
+`, project, project))
+	policies := "include *.raw scans/**; window Mon-Fri 22:00-06:00 UTC; limit 10 files per run"
+	diff := fmt.Sprintf("add delegation for nobody on %s (%s)\nchange delegation for daemon on %s from no policies to %s\nchange delegation for nobody on %s/drop from once to dispatch", project, policies, project, policies, project)
+
+	v.Run("check the delegations against the manifest",
+		[]string{"-apply", "manifest.yaml", "-check"}, nil,
+	).Must(
+		Print(diff),
+		PrintErr(""),
+		ExitWith(Drift),
+	)
+
+	v.Run("apply the manifest as an unprivileged user",
+		[]string{"apply", "manifest.yaml"}, nil, Unprivileged,
+	).Must(
+		Print(diff),
+		PrintErr("error applying manifest manifest.yaml: cannot add delegation for nobody on %s (%s): operation not permitted", project, policies),
+		ExitWith(PermissionDenied),
+	)
+
+	v.Run("apply the manifest",
+		[]string{"--apply", "manifest.yaml"}, nil,
+	).Must(
+		Print(diff),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("list the delegations established by the manifest",
+		[]string{"-l"}, []string{"project/drop"},
+	).Must(
+		Print("project/drop:\n\tdaemon: via %s (%s)\n\tnobody: via %s/drop (dispatch), %s (%s)", project, policies, project, project, policies),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("check the delegations against the manifest once applied",
+		[]string{"apply", "--check", "manifest.yaml"}, nil, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	// Users are not told whether paths they cannot reach exist.
+	for _, name := range []string{"file", "missing"} {
+		path := filepath.Join(project, "hidden", name)
+		write("hidden.yaml", fmt.Sprintf("paths:\n  %s:\n    - users: nobody\n", path))
+		v.Run("check a manifest listing a hidden "+name+" as an unprivileged user",
+			[]string{"apply", "--check", "hidden.yaml"}, nil, Unprivileged,
+		).Must(
+			Print(""),
+			PrintErr("error checking manifest hidden.yaml: stat %s: lstat %s: permission denied", path, path),
+			ExitWith(OperationError),
+		)
+	}
+
+	// Writing the delegations on the immutable file fails, after those on
+	// the project were revoked, which must then be put back.
+	frozen := filepath.Join(project, "frozen")
+	if err := exec.Command("chattr", "+i", frozen).Run(); err != nil {
+		t.Fatalf("cannot make %s immutable: %v", frozen, err)
+	}
+	defer exec.Command("chattr", "-i", frozen).Run()
+	write("partial.yaml", fmt.Sprintf("paths:\n  %s:\n  %s:\n    - users: [nobody]\n", project, frozen))
+	v.Run("apply a manifest that cannot be applied in full",
+		[]string{"-apply", "partial.yaml"}, nil,
+	).Must(
+		Print("remove delegation for nobody on %s\nremove delegation for daemon on %s\nadd delegation for nobody on %s", project, project, frozen),
+		FinishErrWith("operation not permitted; no delegations were changed"),
+		ExitWith(OperationError),
+	)
+
+	v.Run("check the delegations after the rollback",
+		[]string{"-apply", "manifest.yaml", "-check"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+}
+
+func TestAudit(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	// takeown only writes to the audit log if it exists, so the one of
+	// the tests is created afresh, and removed afterwards.
+	if err := os.MkdirAll(filepath.Dir(AUDITFILE), 0755); err != nil {
+		t.Fatalf("cannot create directory of %s: %v", AUDITFILE, err)
+	}
+	if err := ioutil.WriteFile(AUDITFILE, nil, 0600); err != nil {
+		t.Fatalf("cannot create %s: %v", AUDITFILE, err)
+	}
+	defer os.Remove(AUDITFILE)
+
+	v.Modify("creating files to take",
+		D("audited", 0, 0, 0755),
+		F("audited/mine", 0, 0, 0644),
+		F("audited/theirs", 0, 0, 0644),
+	)
+	audited := filepath.Join(v.Datadir(), "audited")
+
+	v.Run("grant delegation with owner restriction",
+		[]string{"-a", "-owners", "0", v.unprivilegedUser}, []string{"audited"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Modify("changing the owner of a file",
+		F("audited/theirs", 4000, 4000, 0644),
+	)
+
+	v.Run("take ownership of files",
+		nil, []string{"audited/mine", "audited/theirs"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error taking ownership of audited/theirs: delegation does not cover files owned by 4000"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.Run("simulate taking ownership of file",
+		[]string{"-s"}, []string{"audited/theirs"}, Unprivileged,
+	).Must(
+		Print("would transfer 0 bytes in 0 files"),
+		PrintErr("error taking ownership of audited/theirs: delegation does not cover files owned by 4000"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.Run("revoke delegation",
+		[]string{"-d", v.unprivilegedUser}, []string{"audited"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	data, err := ioutil.ReadFile(AUDITFILE)
+	if err != nil {
+		t.Fatalf("cannot read %s: %v", AUDITFILE, err)
+	}
+	events := []AuditEvent{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e AuditEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("malformed audit event %q: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	expected := []struct {
+		action string
+		caller UID
+		path   string
+		result string
+	}{
+		{auditAddGrant, 0, audited, "success"},
+		{auditTake, UID(v.unprivilegedUid), filepath.Join(audited, "mine"), "success"},
+		{auditTake, UID(v.unprivilegedUid), filepath.Join(audited, "theirs"), "delegation does not cover files owned by 4000"},
+		{auditDeleteGrant, 0, audited, "success"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d audit events, got %d: %s", len(expected), len(events), data)
+	}
+	for n, x := range expected {
+		e := events[n]
+		if e.Action != x.action || e.Caller != x.caller || e.Path != x.path || e.Result != x.result {
+			t.Errorf("audit event %d: expected %+v, got %+v", n, x, e)
+		}
+		if e.Delegation == nil || e.Delegation.Path != audited || e.Delegation.Grant.UID != UID(v.unprivilegedUid) {
+			t.Errorf("audit event %d: expected delegation on %s for %d, got %+v", n, audited, v.unprivilegedUid, e.Delegation)
+		}
+	}
+	if e := events[1]; e.OldOwner == nil || *e.OldOwner != 0 || e.NewOwner == nil || *e.NewOwner != UID(v.unprivilegedUid) || e.Inode == 0 {
+		t.Errorf("audit event of ownership change lacks owners or inode: %+v", e)
+	}
+	if owners := events[1].Delegation.Grant.Owners; len(owners) != 1 {
+		t.Errorf("audit event of ownership change lacks the owner restriction of the grant: %+v", owners)
+	}
+
+	if err := os.Chmod(AUDITFILE, 0666); err != nil {
+		t.Fatalf("cannot chmod %s: %v", AUDITFILE, err)
+	}
+	v.Run("list delegations with a world-writable audit log",
+		[]string{"-l"}, []string{"audited"},
+	).Must(
+		Print(""),
+		PrintErr(fmt.Sprintf("error opening audit log: open %s: file must be a regular file owned and only writable by root", AUDITFILE)),
+		ExitWith(BadConfig),
+	)
+	saved := AUDITFILE + ".saved"
+	if err := os.Rename(AUDITFILE, saved); err != nil {
+		t.Fatalf("cannot rename %s: %v", AUDITFILE, err)
+	}
+	defer os.Remove(saved)
+	if err := os.Symlink(saved, AUDITFILE); err != nil {
+		t.Fatalf("cannot replace %s with a symbolic link: %v", AUDITFILE, err)
+	}
+	v.Run("list delegations with an audit log that is a symbolic link",
+		[]string{"-l"}, []string{"audited"},
+	).Must(
+		Print(""),
+		PrintErr(fmt.Sprintf("error opening audit log: open %s: too many levels of symbolic links", AUDITFILE)),
+		ExitWith(BadConfig),
+	)
+}
+
+// decodeResults parses the output of takeown -format json.
+func decodeResults(t *testing.T, r *RunResult) (status int, results []Result) {
+	var doc struct {
+		Status  int      `json:"status"`
+		Results []Result `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(r.out), &doc); err != nil {
+		t.Fatalf("while %s: malformed JSON output %q: %v", r.v.lastDescription, r.out, err)
+	}
+	if doc.Status != r.exit {
+		t.Errorf("while %s: JSON status %d differs from exit status %d", r.v.lastDescription, doc.Status, r.exit)
+	}
+	return doc.Status, doc.Results
+}
+
+func TestOutputFormats(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a directory with a comma in its name",
+		D("a,b", 0, 0, 0755),
+		F("a,b/file", 0, 0, 0644),
+		F("a,b/other", 0, 0, 0644),
+	)
+	dir := filepath.Join(v.Datadir(), "a,b")
+
+	v.Run("use an invalid output format",
+		[]string{"-format", "xml", "-l"}, []string{"a,b"},
+	).Must(
+		Print(""),
+		PrintErr(`error: invalid output format "xml" (valid formats are text, json and nul)`),
+		ExitWith(Usage),
+	)
+
+	r := v.Run("grant delegation with JSON output",
+		[]string{"-format", "json", "-a", v.unprivilegedUser}, []string{"a,b"},
+	).Must(
+		PrintErr(""),
+		Succeed(),
+	)
+	if _, results := decodeResults(t, r); len(results) != 1 || results[0].Action != "add-grant" || results[0].Path != "a,b" || results[0].Status != Success {
+		t.Errorf("unexpected results of adding a delegation: %+v", results)
+	}
+
+	r = v.Run("list delegations with JSON output",
+		[]string{"-format", "json", "-l"}, []string{"a,b"},
+	).Must(
+		PrintErr(""),
+		Succeed(),
+	)
+	if _, results := decodeResults(t, r); len(results) != 1 || len(results[0].Delegations) != 1 {
+		t.Errorf("unexpected results of listing delegations: %+v", results)
+	} else if d := results[0].Delegations[0]; d.Path != dir || d.User != v.unprivilegedUser || d.Grant.UID != UID(v.unprivilegedUid) {
+		t.Errorf("unexpected delegation listed: %+v", d)
+	}
+
+	v.Run("grant another delegation on the directory with a comma",
+		[]string{"-a", "daemon"}, []string{"a,b"},
+	).Must(
+		SucceedQuietly()...,
+	)
+	v.Run("list delegations with NUL-separated output",
+		[]string{"-format", "nul", "-l"}, []string{"a,b"},
+	).Must(
+		Print("0\x00a,b\x00\x00daemon\x00%s\x000\x00a,b\x00\x00%s\x00%s\x00", dir, v.unprivilegedUser, dir),
+		PrintErr(""),
+		Succeed(),
+	)
+	v.Run("revoke the other delegation on the directory with a comma",
+		[]string{"-d", "daemon"}, []string{"a,b"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("simulate taking ownership with NUL-separated output",
+		[]string{"-format", "nul", "-s"}, []string{"a,b/other"}, Unprivileged,
+	).Must(
+		Print("0\x00a,b/other\x00would take ownership of a,b/other\x00\x00\x000\x00\x00would transfer 0 bytes in 1 file\x00\x00\x00"),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	r = v.Run("take ownership with JSON output",
+		[]string{"-format", "json"}, []string{"a,b/file", "a,b/missing"}, Unprivileged,
+	).Must(
+		PrintErr(""),
+		ExitWith(OperationError),
+	).Causes(
+		Stat("a,b/file", v.unprivilegedUid),
+	)
+	status, results := decodeResults(t, r)
+	if status != OperationError || len(results) != 2 {
+		t.Fatalf("unexpected results of taking ownership: %+v", results)
+	}
+	if x := results[0]; x.Action != "take" || x.Path != "a,b/file" || x.Status != Success || x.Message != "took ownership of a,b/file" || x.Error != nil {
+		t.Errorf("unexpected result of taking ownership of a file: %+v", x)
+	}
+	if x := results[1]; x.Action != "take" || x.Path != "a,b/missing" || x.Status != OperationError || x.Error == nil || !strings.Contains(x.Error.Err, "no such file or directory") {
+		t.Errorf("unexpected result of taking ownership of a missing file: %+v", x)
+	}
+}
+
+func TestFilesFrom(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating files to take",
+		D("listed", 0, 0, 0755),
+		F("listed/a", 0, 0, 0644),
+		F("listed/b", 0, 0, 0644),
+		F("listed/c", 0, 0, 0644),
+		F("listed/d\nnewline", 0, 0, 0644),
+		F("secret", 0, 0, 0600),
+	)
+	lists := map[string]string{
+		"dirs":  "listed\n",
+		"lines": "listed/a\n\nlisted/b\n",
+		"nuls":  "listed/c\x00listed/d\nnewline\x00",
+	}
+	for name, content := range lists {
+		fullpath := filepath.Join(v.Datadir(), name)
+		if err := ioutil.WriteFile(fullpath, []byte(content), 0644); err != nil {
+			t.Fatalf("cannot write %s: %v", fullpath, err)
+		}
+	}
+
+	v.Run("use NUL-separated input without a file list",
+		[]string{"-0"}, []string{"listed/a"}, Unprivileged,
+	).Must(
+		ExitWithUsage()...,
+	)
+
+	v.Run("grant delegation on paths from a file",
+		[]string{"-a", "-files-from", "dirs", v.unprivilegedUser}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list delegations on paths from a file",
+		[]string{"-l", "-files-from", "dirs"}, nil,
+	).Must(
+		Print("listed:\n\t%s: via %s", v.unprivilegedUser, filepath.Join(v.Datadir(), "listed")),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("read paths from a file the user cannot read",
+		[]string{"-files-from", "secret"}, nil, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error reading paths from secret: open secret: permission denied"),
+		ExitWith(OperationError),
+	)
+
+	v.Run("take ownership of paths from a file",
+		[]string{"-v", "-files-from", "lines"}, nil, Unprivileged,
+	).Must(
+		Print("took ownership of listed/a\ntook ownership of listed/b"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("listed/a", v.unprivilegedUid),
+		Stat("listed/b", v.unprivilegedUid),
+	)
+
+	v.Run("take ownership of paths from a NUL-separated file and the command line",
+		[]string{"-v", "-0", "-files-from", "nuls"}, []string{"listed/a"}, Unprivileged,
+	).Must(
+		Print("file listed/a already owned\ntook ownership of listed/c\ntook ownership of listed/d\nnewline"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("listed/c", v.unprivilegedUid),
+		Stat("listed/d\nnewline", v.unprivilegedUid),
+	)
+
+	v.Run("revoke delegation on paths from a file",
+		[]string{"-d", "-files-from", "dirs", v.unprivilegedUser}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+}
+
+func TestSubcommands(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a tree",
+		D("tree", 0, 0, 0755),
+		D("tree/sub", 4000, 4000, 0755),
+		F("tree/sub/file", 4000, 4000, 0644),
+		F("grant", 4000, 4000, 0644),
+	)
+	tree := filepath.Join(v.Datadir(), "tree")
+
+	r := v.Run("show the help of a subcommand",
+		[]string{"take", "--help"}, nil, Unprivileged,
+	).Must(
+		PrintErr(""),
+		Succeed(),
+	)
+	if !strings.HasPrefix(r.out, "Usage: takeown take [OPTION]... PATH...\n") || !strings.Contains(r.out, "-r, --recursive") {
+		t.Errorf("unexpected help of take: %q", r.out)
+	}
+
+	v.Run("run a subcommand without arguments",
+		[]string{"grant", "--dispatch", v.unprivilegedUser}, nil,
+	).Must(
+		Print(""),
+		PrintErr("takeown grant: missing arguments\nTry 'takeown grant --help' for more information."),
+		ExitWith(Usage),
+	)
+
+	v.Run("run a subcommand with an unknown option",
+		[]string{"list", "--dispatch"}, nil,
+	).Must(
+		Print(""),
+		PrintErr("takeown list: flag provided but not defined: -dispatch\nTry 'takeown list --help' for more information."),
+		ExitWith(Usage),
+	)
+
+	v.Run("grant delegation with options among the arguments",
+		[]string{"grant", v.unprivilegedUser, "--owners=4000", "tree", "--exclude", "take"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list delegations",
+		[]string{"list", "tree/sub"}, nil,
+	).Must(
+		Print("tree/sub:\n\t%s: via %s (exclude take; owners 4000)", v.unprivilegedUser, tree),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("find delegations of another user",
+		[]string{"find", "--user", "root", "."}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("find delegations",
+		[]string{"find", "-u", v.unprivilegedUser}, nil,
+	).Must(
+		Print("%s: via %s (exclude take; owners 4000)", v.unprivilegedUser, tree),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("release and give away at once",
+		[]string{"take", "--release", "--to", "root", "tree/sub/file"}, nil, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("takeown take: --release and --to are mutually exclusive\nTry 'takeown take --help' for more information."),
+		ExitWith(Usage),
+	)
+
+	v.Run("take ownership recursively with long options",
+		[]string{"take", "--recursive", "tree/sub", "--verbose"}, nil, Unprivileged,
+	).Must(
+		Print("took ownership of tree/sub\ntook ownership of tree/sub/file"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("tree/sub/file", v.unprivilegedUid),
+	)
+
+	v.Run("run a subcommand in a directory with a file named like it",
+		[]string{"grant", "daemon", "grant"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("grant", 4000),
+	)
+
+	v.Run("list the delegation established by the subcommand",
+		[]string{"-l", "grant"}, nil,
+	).Must(
+		Print("grant:\n\tdaemon: via file %s/grant", v.Datadir()),
+		Succeed(),
+	)
+
+	v.Run("take ownership of a file named like a subcommand",
+		[]string{"./grant"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("grant", 0),
+	)
+
+	for _, opts := range [][]string{{"-v", "--", "grant"}, {"-v", "grant"}} {
+		v.Run("take ownership of a file named like a subcommand after "+strings.Join(opts[:len(opts)-1], " "),
+			opts, nil,
+		).Must(
+			Print("file grant already owned"),
+			PrintErr(""),
+			Succeed(),
+		)
+	}
+
+	v.Run("revoke delegation",
+		[]string{"revoke", v.unprivilegedUser, "tree"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+}
+
+func TestCompletion(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a tree",
+		D("tree", 0, 0, 0755),
+		D("other", 0, 0, 0755),
+	)
+
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		r := v.Run("generate completion for "+shell,
+			[]string{"-completion", shell}, nil, Unprivileged,
+		).Must(
+			PrintErr(""),
+			Succeed(),
+		)
+		for _, word := range []string{"grant", "revoke", "max-daily-files", "-completion-delegates"} {
+			if !strings.Contains(r.out, word) {
+				t.Errorf("completion for %s lacks %s", shell, word)
+			}
+		}
+	}
+
+	v.Run("generate completion for an unknown shell",
+		[]string{"-completion", "csh"}, nil,
+	).Must(
+		Print(""),
+		PrintErr("error: no completion for shell \"csh\" (valid shells are bash, zsh and fish)"),
+		ExitWith(Usage),
+	)
+
+	v.Run("grant delegation",
+		[]string{"-a", v.unprivilegedUser, "tree"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("complete users holding delegations",
+		[]string{"-completion-delegates", "--", "tree", "other", "missing"}, nil, Unprivileged,
+	).Must(
+		Print(v.unprivilegedUser),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("complete users holding delegations where there are none",
+		[]string{"-completion-delegates", "other"}, nil, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	)
+}
+
+func TestManual(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Run("show the help",
+		[]string{"--help"}, nil, Unprivileged,
+	).Must(
+		Print(helpText()),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	r := v.Run("print the manual page",
+		[]string{"--man"}, nil, Unprivileged,
+	).Must(
+		PrintErr(""),
+		Succeed(),
+	)
+	for _, want := range []string{
+		".TH TAKEOWN 1",
+		".SS \"takeown grant [OPTION]... USER PATH...\"",
+		"\\fB\\-\\-max\\-daily\\-files\\fR=\\fIN\\fR",
+		"\\fB\\-ignore\\-quota\\fR",
+		"\\fB128\\fR (PermissionDenied)",
+		"\\fIsecurity.takeown.grants\\fR",
+	} {
+		if !strings.Contains(r.out, want) {
+			t.Errorf("manual page lacks %q", want)
+		}
+	}
+	if strings.Contains(r.out, "completion\\-delegates") {
+		t.Errorf("manual page documents a hidden flag")
+	}
+	synopsis := r.out[:strings.Index(r.out, ".SH DESCRIPTION")]
+	for _, f := range legacyFlags {
+		if f.hidden {
+			continue
+		}
+		name := roff("-" + f.name)
+		if !strings.Contains(r.out, ".TP\n\\fB"+name+"\\fR") {
+			t.Errorf("manual page lacks the option %s", name)
+		}
+		if isGrantFlag(f.name) {
+			continue
+		}
+		if !strings.Contains(synopsis, name+" ") && !strings.Contains(synopsis, name+"]") && !strings.Contains(synopsis, name+"\n") {
+			t.Errorf("synopsis of the manual page lacks %s", name)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a tree",
+		D("incoming", 0, 0, 0755),
+		F("incoming/file", 0, 0, 0644),
+		F("incoming/other", 0, 0, 0600),
+	)
+	v.InstallWithCapabilities(capabilitiesSpec)
+
+	v.Run("grant delegation",
+		[]string{"-a", "-file-mode", "0640", v.unprivilegedUser, "incoming"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list delegations without privileges",
+		[]string{"-l", "incoming"}, nil, Unprivileged,
+	).Must(
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("take ownership with capabilities",
+		[]string{"-v"}, []string{"incoming/file", "incoming/other"}, Unprivileged,
+	).Must(
+		Print("took ownership of incoming/file and set mode 0640\ntook ownership of incoming/other and set mode 0640"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("incoming/file", v.unprivilegedUid, 0, 0640),
+		Stat("incoming/other", v.unprivilegedUid, 0, 0640),
+	)
+
+	v.Run("add a delegation without being the administrator",
+		[]string{"-a", v.unprivilegedUser, "incoming"}, nil, Unprivileged,
+	).Must(
+		Print(""),
+		ExitWith(PermissionDenied),
+	)
+
+	for _, c := range []struct {
+		spec    string
+		message string
+	}{
+		{"cap_chown,cap_dac_override,cap_fowner,cap_sys_admin+p", "takeown has capabilities it does not need (cap_dac_override)"},
+		{"cap_chown,cap_fowner+p", "takeown lacks capabilities it needs (cap_sys_admin)"},
+		{"cap_chown,cap_fowner,cap_sys_admin+ep", "takeown must not start with its capabilities effective"},
+	} {
+		v.InstallWithCapabilities(c.spec)
+		v.Run("run with capabilities "+c.spec,
+			[]string{"-l", "incoming"}, nil, Unprivileged,
+		).Must(
+			Print(""),
+			PrintErr("error: %s; install it with %s", c.message, capabilitiesSpec),
+			ExitWith(BadConfig),
+		)
+	}
+
+	for _, c := range []struct {
+		desc    string
+		gid     int
+		mode    os.FileMode
+		message string
+	}{
+		{"without being set-gid", testStateGroup, 0755, "takeown must be set-gid to the group of its state directories to run with capabilities"},
+		{"set-gid to root", 0, 0755 | os.ModeSetgid, "takeown must not be set-gid to root"},
+	} {
+		// Changing the owner of a file clears its capabilities, so
+		// they are set afterwards.
+		if err := os.Lchown(v.takeownPath, 0, c.gid); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(v.takeownPath, c.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := runAndPrintErrors("setcap", capabilitiesSpec, v.takeownPath); err != nil {
+			t.Fatal(err)
+		}
+		v.Run("run with capabilities "+c.desc,
+			[]string{"-l", "incoming"}, nil, Unprivileged,
+		).Must(
+			Print(""),
+			PrintErr("error: %s", c.message),
+			ExitWith(BadConfig),
+		)
+	}
+}
+
+func TestCapabilitiesStateFiles(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	// Installed with capabilities, takeown reaches its state files
+	// through the group it is set-gid to, so the administrator gives the
+	// audit log and the state directories to that group.
+	if err := os.MkdirAll(filepath.Dir(AUDITFILE), 0755); err != nil {
+		t.Fatalf("cannot create directory of %s: %v", AUDITFILE, err)
+	}
+	if err := ioutil.WriteFile(AUDITFILE, nil, 0600); err != nil {
+		t.Fatalf("cannot create %s: %v", AUDITFILE, err)
+	}
+	defer os.Remove(AUDITFILE)
+	if err := os.Chown(AUDITFILE, 0, testStateGroup); err != nil {
+		t.Fatalf("cannot give %s to group %d: %v", AUDITFILE, testStateGroup, err)
+	}
+	if err := os.Chmod(AUDITFILE, 0620); err != nil {
+		t.Fatalf("cannot chmod %s: %v", AUDITFILE, err)
+	}
+
+	v.Modify("creating a tree",
+		D("once", 0, 0, 0755),
+		F("once/file", 0, 0, 0644),
+		D("daily", 0, 0, 0755),
+		F("daily/a", 0, 0, 0644),
+		F("daily/b", 0, 0, 0644),
+		D("wanted", 0, 0, 0755),
+	)
+	daily := filepath.Join(v.Datadir(), "daily")
+
+	// The state directories of the tests are made afresh, as installing
+	// takeown with capabilities makes them, so that takeown creates the
+	// files in them.  Afterwards, they are removed, as takeown installed
+	// set-uid root refuses them.
+	for _, dir := range stateDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatalf("cannot remove %s: %v", dir, err)
+		}
+		if err := os.Mkdir(dir, 0770); err != nil {
+			t.Fatalf("cannot create %s: %v", dir, err)
+		}
+		defer os.RemoveAll(dir)
+		if err := os.Chown(dir, 0, testStateGroup); err != nil {
+			t.Fatalf("cannot give %s to group %d: %v", dir, testStateGroup, err)
+		}
+		if err := os.Chmod(dir, 0770); err != nil {
+			t.Fatalf("cannot chmod %s: %v", dir, err)
+		}
+	}
+	v.InstallWithCapabilities(capabilitiesSpec)
+
+	v.Run("grant a one-shot delegation",
+		[]string{"-a", "-once", v.unprivilegedUser}, []string{"once"},
+	).Must(
+		SucceedQuietly()...,
+	)
+	v.Run("grant a delegation with a daily limit",
+		[]string{"-a", "-max-daily-files", "1", v.unprivilegedUser}, []string{"daily"},
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("take ownership under a one-shot delegation with capabilities",
+		nil, []string{"once/file"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("once/file", v.unprivilegedUid),
+	)
+
+	v.Run("list the used up one-shot delegation",
+		[]string{"-l"}, []string{"once"}, Unprivileged,
+	).Must(
+		Print(""),
+		Succeed(),
+	)
+
+	v.Run("take ownership under a delegation with a daily limit with capabilities",
+		nil, []string{"daily/a"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	).Causes(
+		Stat("daily/a", v.unprivilegedUid),
+	)
+
+	v.Run("take ownership past the daily limit with capabilities",
+		nil, []string{"daily/b"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error: taking ownership of 1 file under the delegation on %s would exceed its limit of 1 file per day (1 already used today)", daily),
+		ExitWith(PermissionDenied),
+	).Causes(
+		Stat("daily/b", 0),
+	)
+
+	v.Run("request a delegation with capabilities",
+		[]string{"-request", "wanted", "-reason", "capable"}, nil, Unprivileged,
+	).Must(
+		Print("requested delegation on wanted as request 1"),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("list own requests with capabilities",
+		[]string{"requests"}, nil, Unprivileged,
+	).Must(
+		Print("request 1 on %s/wanted: pending", v.Datadir()),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	for _, path := range []string{GRANTLOCK, USAGEFILE, SPOOLFILE} {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path, &st); err != nil {
+			t.Errorf("cannot stat %s: %v", path, err)
+			continue
+		}
+		if st.Uid != 0 || st.Gid != testStateGroup || st.Mode&07777 != 0660 {
+			t.Errorf("%s was created owned by %d:%d with mode %o", path, st.Uid, st.Gid, st.Mode&07777)
+		}
+	}
+
+	data, err := ioutil.ReadFile(AUDITFILE)
+	if err != nil {
+		t.Fatalf("cannot read %s: %v", AUDITFILE, err)
+	}
+	audited := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e AuditEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("malformed audit event %q: %v", line, err)
+		}
+		if e.Caller == UID(v.unprivilegedUid) {
+			audited[e.Action] = true
+		}
+	}
+	for _, action := range []string{auditConsume, auditTake, auditRequest} {
+		if !audited[action] {
+			t.Errorf("no %s event was audited with capabilities: %s", action, data)
+		}
+	}
+}
+
+func TestSupplementaryGroups(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a tree",
+		D("pub", 0, 0, 0755),
+		D("pub/group", 0, 1, 0750),
+		F("pub/group/file", 0, 0, 0644),
+	)
+
+	v.Run("take ownership recursively without being able to see the file",
+		[]string{"-r"}, []string{"pub"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error taking ownership of pub: permission denied\nerror taking ownership of pub/group: permission denied"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.supplementaryGroup = "daemon"
+	v.Run("take ownership recursively seeing the file through a supplementary group",
+		[]string{"-r"}, []string{"pub"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error taking ownership of pub: permission denied\nerror taking ownership of pub/group: permission denied\nerror taking ownership of pub/group/file: permission denied"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.InstallWithCapabilities(capabilitiesSpec)
+	v.Run("take ownership recursively with capabilities",
+		[]string{"-r"}, []string{"pub"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error taking ownership of pub: permission denied\nerror taking ownership of pub/group: permission denied\nerror taking ownership of pub/group/file: permission denied"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.supplementaryGroup = ""
+	v.Run("take ownership recursively with capabilities without the group",
+		[]string{"-r"}, []string{"pub"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error taking ownership of pub: permission denied\nerror taking ownership of pub/group: permission denied"),
+		ExitWith(PermissionDenied),
+	)
+}
+
+// sandboxHelper runs in a child of the test, since a sandbox cannot be left.
+// It confines itself to the directory in TAKEOWN_SANDBOX_DIR, and reports
+// whatever it could do that it should not have, or the other way around.
+func sandboxHelper(dir string) {
+	runtime.LockOSThread()
+	failures := []string{}
+	fail := func(format string, args ...interface{}) {
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+	if err := enterSandbox([]string{filepath.Join(dir, "inside")}); err != nil {
+		fail("entering sandbox: %v", err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "inside", "file")); err != nil {
+		fail("reading a file inside the sandbox: %v", err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "outside")); !errors.Is(err, syscall.EACCES) {
+		fail("reading a file outside the sandbox: expected permission denied, got %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "inside", "new"), nil, 0644); !errors.Is(err, syscall.EACCES) {
+		fail("creating a file inside the sandbox: expected permission denied, got %v", err)
+	}
+	if err := exec.Command("/bin/true").Run(); err == nil {
+		fail("running a program succeeded")
+	}
+	if err := syscall.Mount("none", filepath.Join(dir, "inside"), "tmpfs", 0, ""); err != syscall.EPERM {
+		fail("mounting a file system: expected %v, got %v", syscall.EPERM, err)
+	}
+	if len(failures) > 0 {
+		fmt.Fprintln(os.Stderr, strings.Join(failures, "\n"))
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestSandbox(t *testing.T) {
+	if dir := os.Getenv("TAKEOWN_SANDBOX_DIR"); dir != "" {
+		sandboxHelper(dir)
+	}
+
+	dir, err := ioutil.TempDir("", "golang-takeown-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "inside"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"inside/file", "outside"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$")
+	cmd.Env = append(os.Environ(), "TAKEOWN_SANDBOX_DIR="+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("sandbox: %v\n%s", err, out)
+	}
+
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a tree",
+		D("incoming", 0, 0, 0755),
+		F("incoming/file", 0, 0, 0644),
+	)
+
+	v.Run("disable the sandbox without being the administrator",
+		[]string{"-no-sandbox", "-l", "incoming"}, nil, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error: only the administrator may disable the sandbox"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.Run("grant delegation without the sandbox",
+		[]string{"grant", "--no-sandbox", v.unprivilegedUser, "incoming"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("take ownership in the sandbox",
+		[]string{"-v"}, []string{"incoming/file"}, Unprivileged,
+	).Must(
+		Print("took ownership of incoming/file"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("incoming/file", v.unprivilegedUid, 0, 0644),
+	)
+}
+
+// runTraced runs the program as the unprivileged user under ptrace, and
+// returns its standard error and exit status.  runuser is traced from the
+// start, by root, and so is the child it runs the program in.
+func (v *TestingVM) runTraced(args ...string) (string, int) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	stderr, err := ioutil.TempFile("", "golang-takeown-stderr")
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+	c := exec.Command("runuser", append([]string{"-u", v.unprivilegedUser, "--", v.takeownPath}, args...)...)
+	c.Dir = v.mountpointForTestData
+	c.Stderr = stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Ptrace: true}
+	if err := c.Start(); err != nil {
+		v.t.Fatal(err)
+	}
+	started := false
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WALL, nil)
+		if err != nil {
+			v.t.Fatal(err)
+		}
+		if status.Exited() || status.Signaled() {
+			if pid != c.Process.Pid {
+				continue
+			}
+			if status.Signaled() {
+				v.t.Fatalf("traced program killed by %v", status.Signal())
+			}
+			out, _ := ioutil.ReadFile(stderr.Name())
+			return strings.TrimSuffix(string(out), "\n"), status.ExitStatus()
+		}
+		if !started {
+			if err := syscall.PtraceSetOptions(pid, syscall.PTRACE_O_TRACEFORK|syscall.PTRACE_O_TRACEVFORK|syscall.PTRACE_O_TRACECLONE); err != nil {
+				v.t.Fatal(err)
+			}
+			started = true
+		}
+		// Stops for events, new processes and exec are not signals to
+		// pass on.
+		sig := status.StopSignal()
+		if sig == syscall.SIGTRAP || sig == syscall.SIGSTOP {
+			sig = 0
+		}
+		syscall.PtraceCont(pid, int(sig))
+	}
+}
+
+func TestInheritedState(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a tree",
+		D("incoming", 0, 0, 0755),
+		F("incoming/file", 0, 0, 0644),
+	)
+	v.Run("grant delegation",
+		[]string{"-a", v.unprivilegedUser, "incoming"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.shell = "umask 777; ulimit -S -f 16; ulimit -S -n 16; exec 7</etc/passwd"
+	v.Run("take ownership with a hostile umask, limits and descriptors",
+		[]string{"-v"}, []string{"incoming/file"}, Unprivileged,
+	).Must(
+		Print("took ownership of incoming/file"),
+		PrintErr(""),
+		Succeed(),
+	).Causes(
+		Stat("incoming/file", v.unprivilegedUid, 0, 0644),
+	)
+
+	v.shell = "ulimit -f 16"
+	v.Run("run with a hard file size limit",
+		[]string{"-l"}, []string{"incoming"}, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error: the file size limit is 8192, but takeown needs unlimited"),
+		ExitWith(OperationError),
+	)
+
+	// Closed standard descriptors are replaced with /dev/null before main
+	// runs, so they cannot be told apart from descriptors redirected to
+	// it, and both must work.
+	listing := fmt.Sprintf("incoming:\n\t%s: via %s/incoming", v.unprivilegedUser, v.Datadir())
+	for _, fd := range []string{"0", "1", "2"} {
+		for desc, redirect := range map[string]string{"closed": ">&-", "open on /dev/null": "<>/dev/null"} {
+			v.shell = "exec " + fd + redirect
+			r := v.Run("run with descriptor "+fd+" "+desc,
+				[]string{"-l"}, []string{"incoming"}, Privileged,
+			)
+			r.Must(Succeed())
+			if fd != "1" {
+				r.Must(Print(listing))
+			}
+		}
+	}
+	v.shell = ""
+
+	stderr, exit := v.runTraced("-l", "incoming")
+	if stderr != "error: takeown must not run while being traced" || exit != PermissionDenied {
+		t.Errorf("running under ptrace: got exit code %d and stderr %q", exit, stderr)
+	}
+}
+
+func TestGrantManagers(t *testing.T) {
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a tree",
+		D("team", 0, 0, 0755),
+		D("team/sub", 0, 0, 0755),
+		F("team/sub/file", 0, 0, 0644),
+		D("other", 0, 0, 0755),
+		D("team/hidden", 0, 0, 0700),
+		F("team/hidden/file", 0, 0, 0644),
+	)
+	if err := os.Symlink("../other", filepath.Join(v.Datadir(), "team/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("team", filepath.Join(v.Datadir(), "teamlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	v.Run("make nobody a grant manager",
+		[]string{"-a", "-manage", v.unprivilegedUser, "team"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("add a delegation as a grant manager",
+		[]string{"grant", "--owners", "root", "daemon", "team/sub"}, nil, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list the delegations",
+		[]string{"-l", "team/sub"}, nil,
+	).Must(
+		Print("team/sub:\n\tdaemon: via %s/team/sub (owners root)\n\tnobody: via %s/team (manage)", v.Datadir(), v.Datadir()),
+		Succeed(),
+	)
+
+	for _, c := range []struct {
+		desc string
+		opts []string
+		path string
+	}{
+		{"add a delegation outside the managed tree", []string{"-a", "daemon"}, "other"},
+		{"give the right to manage delegations", []string{"-a", "-manage", "daemon"}, "team/sub"},
+		{"revoke the own right to manage delegations", []string{"-d", v.unprivilegedUser}, "team"},
+	} {
+		v.Run(c.desc,
+			c.opts, []string{c.path}, Unprivileged,
+		).Must(
+			Print(""),
+			FinishErrWith("operation not permitted"),
+			ExitWith(PermissionDenied),
+		)
+	}
+
+	for who, privilege := range map[string]Privilege{"grant manager": Unprivileged, "administrator": Privileged} {
+		v.Run("add a delegation on a symbolic link leading outside the managed tree as the "+who,
+			[]string{"-a", "daemon"}, []string{"team/link"}, privilege,
+		).Must(
+			Print(""),
+			PrintErr("error adding delegation for user daemon on path team/link: change grants team/link: symbolic links cannot carry grants"),
+			ExitWith(OperationError),
+		)
+	}
+
+	v.Run("list the delegations on where the symbolic link leads",
+		[]string{"-l", "other"}, nil,
+	).Must(
+		Print(""),
+		Succeed(),
+	)
+
+	for _, name := range []string{"file", "missing"} {
+		v.Run("add a delegation on a "+name+" in a directory the grant manager cannot search",
+			[]string{"-a", "daemon"}, []string{"team/hidden/" + name}, Unprivileged,
+		).Must(
+			Print(""),
+			PrintErr("error adding delegation for user daemon on path team/hidden/%s: stat team/hidden/%s: lstat team/hidden/%s: permission denied", name, name, name),
+			ExitWith(OperationError),
+		)
+	}
+
+	v.Run("add a delegation through a symbolic link to the managed tree",
+		[]string{"-a", "daemon"}, []string{"teamlink/sub/file"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list the delegations where the symbolic link leads",
+		[]string{"-l", "team/sub/file"}, nil,
+	).Must(
+		Print("team/sub/file:\n\tdaemon: via file %s/team/sub/file, %s/team/sub (owners root)\n\tnobody: via %s/team (manage)", v.Datadir(), v.Datadir(), v.Datadir()),
+		Succeed(),
+	)
+
+	v.Run("revoke the delegation through the symbolic link",
+		[]string{"-d", "daemon"}, []string{"teamlink/sub/file"}, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("make daemon a grant manager too",
+		[]string{"-a", "-manage", "daemon", "team/sub"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	for _, opts := range [][]string{{"-a", "daemon"}, {"-d", "daemon"}} {
+		v.Run("change the delegation of another grant manager "+opts[0],
+			opts, []string{"team/sub"}, Unprivileged,
+		).Must(
+			Print(""),
+			PrintErr("error %s delegation for user daemon on path team/sub: operation not permitted", map[string]string{"-a": "adding", "-d": "removing"}[opts[0]]),
+			ExitWith(PermissionDenied),
+		)
+	}
+
+	v.Run("revoke the right of daemon to manage delegations",
+		[]string{"-d", "daemon", "team/sub"}, nil,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("add a delegation on a file as a grant manager",
+		[]string{"-a", "daemon", "team/sub/file"}, nil, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("revoke a delegation as a grant manager",
+		[]string{"revoke", "daemon", "team/sub/file"}, nil, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list the delegations after revoking",
+		[]string{"-l", "team/sub/file"}, nil,
+	).Must(
+		Print("team/sub/file:\n\tnobody: via %s/team (manage)", v.Datadir()),
+		Succeed(),
+	)
+}
+
+func TestRequests(t *testing.T) {
+	// The spool of the tests starts empty, so requests get known IDs.
+	if err := os.Remove(SPOOLFILE); err != nil && !os.IsNotExist(err) {
+		t.Fatalf("cannot remove %s: %v", SPOOLFILE, err)
+	}
+
+	v := i(t)
+	defer d(v)
+
+	v.Modify("creating a tree",
+		D("projects", 0, 0, 0755),
+		D("projects/scans", 0, 0, 0755),
+		D("secret", 0, 0, 0700),
+		F("secret/file", 0, 0, 0644),
+	)
+
+	for n := 0; n < 2; n++ {
+		v.Run("request a delegation",
+			[]string{"-request", "projects/scans", "-reason", "need the scans"}, nil, Unprivileged,
+		).Must(
+			Print("requested delegation on projects/scans as request 1"),
+			PrintErr(""),
+			Succeed(),
+		)
+	}
+
+	v.Run("request a delegation on a path that cannot be seen",
+		[]string{"request", "--reason", "curious"}, []string{"secret/file"}, Unprivileged,
+	).Must(
+		Print(""),
+		FinishErrWith("permission denied"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.Run("request a delegation without a reason",
+		[]string{"-request", "projects"}, nil, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error: -request needs a -reason"),
+		ExitWith(Usage),
+	)
+
+	v.Run("list pending requests without managing delegations",
+		[]string{"-pending"}, nil, Unprivileged,
+	).Must(
+		SucceedQuietly()...,
+	)
+
+	v.Run("list pending requests",
+		[]string{"pending"}, nil,
+	).Must(
+		Print("request 1 from nobody on %s/projects/scans: need the scans", v.Datadir()),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("approve a request without managing delegations",
+		[]string{"-approve", "1"}, nil, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error approving request 1: operation not permitted"),
+		ExitWith(PermissionDenied),
+	)
+
+	v.Run("approve a request",
+		[]string{"approve", "--owners", "root", "1"}, nil,
+	).Must(
+		Print("approved request 1 from nobody on %s/projects/scans", v.Datadir()),
+		PrintErr(""),
+		Succeed(),
+	)
+
+	v.Run("list the delegation established by the approval",
+		[]string{"-l", "projects/scans"}, nil,
+	).Must(
+		Print("projects/scans:\n\tnobody: via %s/projects/scans (owners root)", v.Datadir()),
+		Succeed(),
+	)
+
+	v.Run("approve a request again",
+		[]string{"-approve", "1"}, nil,
+	).Must(
+		Print(""),
+		PrintErr("error approving request 1: request is already approved"),
+		ExitWith(OperationError),
+	)
+
+	v.Run("request another delegation",
+		[]string{"request", "--reason", "need the rest"}, []string{"projects"}, Unprivileged,
+	).Must(
+		Print("requested delegation on projects as request 2"),
+		Succeed(),
+	)
+
+	v.Run("reject a request",
+		[]string{"-reject", "2"}, nil,
+	).Must(
+		Print("rejected request 2 from nobody on %s/projects", v.Datadir()),
+		Succeed(),
+	)
+
+	v.Run("decide requests that do not exist",
+		[]string{"reject", "3", "x"}, nil,
+	).Must(
+		Print(""),
+		PrintErr("error rejecting request 3: no such request\nerror rejecting request x: invalid request ID"),
+		ExitWith(Usage),
+	)
+
+	v.Run("list own requests",
+		[]string{"requests"}, nil, Unprivileged,
+	).Must(
+		Print("request 1 on %s/projects/scans: approved by root\nrequest 2 on %s/projects: rejected by root", v.Datadir(), v.Datadir()),
+		PrintErr(""),
+		Succeed(),
+	)
+	v.Modify("creating a directory the requester controls",
+		D("drop", v.unprivilegedUid, 0, 0755),
+		D("drop/mine", v.unprivilegedUid, 0, 0755),
+		D("system", 0, 0, 0755),
+	)
+
+	v.Run("request a delegation on a directory the requester controls",
+		[]string{"-request", "drop/mine", "-reason", "mine"}, nil, Unprivileged,
+	).Must(
+		Print("requested delegation on drop/mine as request 3"),
+		Succeed(),
+	)
+
+	mine := filepath.Join(v.Datadir(), "drop/mine")
+	if err := os.Rename(mine, mine+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../system", mine); err != nil {
+		t.Fatal(err)
+	}
+	v.Run("approve a request on a path swapped for a symbolic link",
+		[]string{"-approve", "3"}, nil,
+	).Must(
+		Print(""),
+		PrintErr("error approving request 3: %s is no longer the path requested", mine),
+		ExitWith(OperationError),
+	)
+
+	if err := os.Remove(mine); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(mine, 0755); err != nil {
+		t.Fatal(err)
+	}
+	v.Run("approve a request on a path swapped for another directory",
+		[]string{"-approve", "3"}, nil,
+	).Must(
+		Print(""),
+		PrintErr("error approving request 3: %s is no longer the path requested", mine),
+		ExitWith(OperationError),
+	)
+
+	v.Run("list the delegations where the swapped paths lead",
+		[]string{"-l"}, []string{"system", "drop/mine"},
+	).Must(
+		Print(""),
+		Succeed(),
+	)
+
+	if err := os.Remove(mine); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(mine+".old", mine); err != nil {
+		t.Fatal(err)
+	}
+	v.Run("approve a request on the path requested",
+		[]string{"-approve", "3"}, nil,
+	).Must(
+		Print("approved request 3 from nobody on %s", mine),
+		Succeed(),
+	)
+	for _, c := range []struct {
+		desc   string
+		reason string
+		err    string
+	}{
+		{"a reason that is too long", strings.Repeat("x", 501), "the reason may be at most 500 bytes long"},
+		{"a reason with terminal escapes", "\x1b]2;owned\x07", "the reason may not contain control characters"},
+		{"a reason with newlines", "first\nsecond", "the reason may not contain control characters"},
+	} {
+		v.Run("request a delegation with "+c.desc,
+			[]string{"-request", "projects", "-reason", c.reason}, nil, Unprivileged,
+		).Must(
+			Print(""),
+			PrintErr("error: %s", c.err),
+			ExitWith(Usage),
+		)
+		v.Run("request a delegation with "+c.desc+" using the command",
+			[]string{"request", "--reason", c.reason, "projects"}, nil, Unprivileged,
+		).Must(
+			Print(""),
+			PrintErr("takeown request: %s\nTry 'takeown request --help' for more information.", c.err),
+			ExitWith(Usage),
+		)
+	}
+
+	many := []string{}
+	requested := []string{}
+	dirs := []Request{D("many", 0, 0, 0755)}
+	for n := 0; n <= 10; n++ {
+		path := fmt.Sprintf("many/%d", n)
+		dirs = append(dirs, D(path, 0, 0, 0755))
+		many = append(many, path)
+		if n < 10 {
+			requested = append(requested, fmt.Sprintf("requested delegation on %s as request %d", path, n+4))
+		}
+	}
+	v.Modify("creating directories to request", dirs...)
+	v.Run("request more delegations than may be pending",
+		[]string{"request", "--reason", "many"}, many, Unprivileged,
+	).Must(
+		Print(strings.Join(requested, "\n")),
+		PrintErr("error requesting delegation on many/10: too many pending requests; at most 10 may be pending at once"),
+		ExitWith(OperationError),
+	)
+	// Only the spool of the tests is made writable by others than root,
+	// and never by everyone.
+	if err := os.Chmod(SPOOLFILE, 0620); err != nil {
+		t.Fatal(err)
+	}
+	v.Run("list own requests with a spool its group may write",
+		[]string{"requests"}, nil, Unprivileged,
+	).Must(
+		Print(""),
+		PrintErr("error opening request spool: open %s: file must be a regular file owned and only writable by root", SPOOLFILE),
+		ExitWith(OperationError),
+	)
+	if err := os.Chmod(SPOOLFILE, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type UID uint32
 
 type UIDList []UID
@@ -77,3 +84,98 @@ func (a UIDList) Equal(b UIDList) bool {
 	}
 	return equal
 }
+
+// UIDRange is an inclusive range of UIDs.
+type UIDRange struct {
+	First UID
+	Last  UID
+}
+
+func (r UIDRange) String() string {
+	if r.First == r.Last {
+		return string(uidToUserOrStringifiedUid(r.First))
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// MarshalJSON stores single UIDs as numbers, and ranges as strings.
+func (r UIDRange) MarshalJSON() ([]byte, error) {
+	if r.First == r.Last {
+		return json.Marshal(r.First)
+	}
+	return json.Marshal(fmt.Sprintf("%d-%d", r.First, r.Last))
+}
+
+func (r *UIDRange) UnmarshalJSON(data []byte) error {
+	var uid UID
+	if err := json.Unmarshal(data, &uid); err == nil {
+		*r = UIDRange{uid, uid}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	p, err := parseUIDRange(s)
+	if err != nil {
+		return err
+	}
+	*r = p
+	return nil
+}
+
+func parseUIDRange(s string) (UIDRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return UIDRange{}, fmt.Errorf("invalid UID range %q", s)
+	}
+	first, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return UIDRange{}, fmt.Errorf("invalid UID range %q", s)
+	}
+	last, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil || last < first {
+		return UIDRange{}, fmt.Errorf("invalid UID range %q", s)
+	}
+	return UIDRange{UID(first), UID(last)}, nil
+}
+
+// UIDRanges is a set of users, expressed as a list of UID ranges.
+type UIDRanges []UIDRange
+
+// ParseUIDRanges parses a comma-separated list of user names, UIDs and
+// ranges of UIDs such as 60000-65000.
+func ParseUIDRanges(s string) (UIDRanges, error) {
+	result := UIDRanges{}
+	for _, item := range strings.Split(s, ",") {
+		if strings.Contains(item, "-") {
+			if r, err := parseUIDRange(item); err == nil {
+				result = append(result, r)
+				continue
+			}
+		}
+		uid, err := userToUidOrStringUid(PotentialUsername(item))
+		if err != nil {
+			return nil, fmt.Errorf("error determining UID for user %s: %v", item, err)
+		}
+		result = append(result, UIDRange{uid, uid})
+	}
+	return result, nil
+}
+
+func (r UIDRanges) Has(uid UID) bool {
+	for _, x := range r {
+		if x.First <= uid && uid <= x.Last {
+			return true
+		}
+	}
+	return false
+}
+
+func (r UIDRanges) String() string {
+	s := []string{}
+	for _, x := range r {
+		s = append(s, x.String())
+	}
+	return strings.Join(s, ",")
+}
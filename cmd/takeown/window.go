@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dayNames are the names of the days of the week windows accept, indexed
+// by time.Weekday.
+var dayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// weekOrder is the order in which the days of a window are written out.
+var weekOrder = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+
+// TimeWindow is a span of time on some days of the week, such as
+// Mon-Fri 22:00-06:00.  A window that ends before it starts runs past
+// midnight into the day after each of its days.  It is stored the way it
+// is written.
+type TimeWindow struct {
+	// Days are the days the window starts on, indexed by time.Weekday.
+	Days [7]bool
+	// Start and End are minutes since midnight.  End may be 24:00.
+	Start int
+	End   int
+}
+
+// ParseTimeWindow parses a window written as [DAYS] HH:MM-HH:MM, where DAYS
+// is a comma-separated list of days or ranges of days, such as Mon-Fri or
+// Sat,Sun.  Without DAYS, the window applies every day.
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	w := TimeWindow{}
+	invalid := fmt.Errorf("invalid time window %q", s)
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, invalid
+	}
+	if len(fields) == 1 {
+		for d := range w.Days {
+			w.Days[d] = true
+		}
+	} else {
+		for _, part := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			first, ok := parseDay(bounds[0])
+			last := first
+			if ok && len(bounds) == 2 {
+				last, ok = parseDay(bounds[1])
+			}
+			if !ok {
+				return w, invalid
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.Days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+	times := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(times) != 2 {
+		return w, invalid
+	}
+	var err error
+	if w.Start, err = parseClock(times[0]); err != nil || w.Start == 24*60 {
+		return w, invalid
+	}
+	if w.End, err = parseClock(times[1]); err != nil {
+		return w, invalid
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("invalid time window %q: it starts and ends at the same time", s)
+	}
+	return w, nil
+}
+
+func parseDay(s string) (time.Weekday, bool) {
+	for d, name := range dayNames {
+		if strings.EqualFold(s, name) {
+			return time.Weekday(d), true
+		}
+	}
+	return 0, false
+}
+
+// parseClock parses a time of day written as HH:MM, up to 24:00, into
+// minutes since midnight.
+func parseClock(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[0]) > 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// Contains returns true if the time, taken in the time zone of the
+// window, falls within it.
+func (w TimeWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.Start < w.End {
+		return w.Days[day] && minute >= w.Start && minute < w.End
+	}
+	return w.Days[day] && minute >= w.Start || w.Days[(day+6)%7] && minute < w.End
+}
+
+func (w TimeWindow) String() string {
+	clock := fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+	days := []string{}
+	for n := 0; n < len(weekOrder); n++ {
+		if !w.Days[weekOrder[n]] {
+			continue
+		}
+		first := n
+		for n+1 < len(weekOrder) && w.Days[weekOrder[n+1]] {
+			n++
+		}
+		if n == first {
+			days = append(days, dayNames[weekOrder[n]])
+		} else {
+			days = append(days, dayNames[weekOrder[first]]+"-"+dayNames[weekOrder[n]])
+		}
+	}
+	if len(days) == 1 && days[0] == "Mon-Sun" {
+		return clock
+	}
+	return strings.Join(days, ",") + " " + clock
+}
+
+func (w TimeWindow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.String())
+}
+
+func (w *TimeWindow) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseTimeWindow(s)
+	if err != nil {
+		return err
+	}
+	*w = parsed
+	return nil
+}
+
+// windowList is a flag that may be given several times, each time adding
+// a time window to the list.
+type windowList []TimeWindow
+
+func (l *windowList) String() string {
+	s := []string{}
+	for _, w := range *l {
+		s = append(s, w.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func (l *windowList) Set(s string) error {
+	w, err := ParseTimeWindow(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, w)
+	return nil
+}
@@ -7,22 +7,54 @@ import (
 	"github.com/pkg/xattr"
 )
 
+func isNoData(err error) bool {
+	if xerr, ok := err.(*xattr.Error); ok {
+		if serr, ok := xerr.Err.(syscall.Errno); ok {
+			if serr == syscall.ENODATA {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func getxattr(path string, attrname string) (*[]byte, error) {
-	data, err := xattr.Get(path, ATTRNAME)
+	data, err := xattr.Get(path, attrname)
 	if err != nil {
-		if xerr, ok := err.(*xattr.Error); ok {
-			if serr, ok := xerr.Err.(syscall.Errno); ok {
-				if serr == syscall.ENODATA {
-					// Attribute not present.  We ignore and continue.
-					return nil, nil
-				}
-			}
+		if isNoData(err) {
+			// Attribute not present.  We ignore and continue.
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &data, nil
+}
+
+// lgetxattr is like getxattr, but does not follow symbolic links.
+func lgetxattr(path string, attrname string) (*[]byte, error) {
+	data, err := xattr.LGet(path, attrname)
+	if err != nil {
+		if isNoData(err) {
+			return nil, nil
 		}
 		return nil, err
 	}
 	return &data, nil
 }
 
+// lsetxattr sets the attribute on the path without following symbolic
+// links.  A nil value removes the attribute instead.
+func lsetxattr(path string, attrname string, data *[]byte) error {
+	if data == nil {
+		err := xattr.LRemove(path, attrname)
+		if err != nil && isNoData(err) {
+			return nil
+		}
+		return err
+	}
+	return xattr.LSet(path, attrname, *data)
+}
+
 func UnmarshalFromXattr(path string, attrname string, s interface{}) error {
 	attr, err := getxattr(path, attrname)
 	if err != nil {
@@ -47,3 +79,13 @@ func MarshalToXattr(path string, attrname string, s interface{}) error {
 	}
 	return setxattr(path, attrname, data)
 }
+
+// LMarshalToXattr is like MarshalToXattr, but does not follow symbolic
+// links.
+func LMarshalToXattr(path string, attrname string, s interface{}) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return NewError("marshal", path, err)
+	}
+	return lsetxattr(path, attrname, &data)
+}
@@ -5,4 +5,6 @@ go 1.15
 require (
 	github.com/pkg/xattr v0.4.7
 	github.com/syndtr/gocapability v0.0.0-20200815063812-42c35b437635
+	go.yaml.in/yaml/v2 v2.4.4
+	golang.org/x/sys v0.0.0-20220408201424-a24fb2fb8a0f
 )
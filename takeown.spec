@@ -13,7 +13,7 @@ License:        GPL
 Group:          System administration tools
 Source:         %{name}-%ver.tar.gz
 URL:            https://github.com/Rudd-O/takeown
-BuildRequires:  golang, python3
+BuildRequires:  golang
 
 %package kde
 Summary:        Context menus for KDE file managers to run takeown
@@ -43,11 +43,12 @@ to invoke takeown.
 make
 
 %install
-make install DESTDIR=$RPM_BUILD_ROOT BINDIR=%{_bindir} DATADIR=%{_datadir}
+make install DESTDIR=$RPM_BUILD_ROOT BINDIR=%{_bindir} DATADIR=%{_datadir} MANDIR=%{_mandir}
 
 %files
 %defattr(-,root,root)
 %attr(4755, root, root) %{_bindir}/%{name}
+%{_mandir}/man1/%{name}.1*
 
 %files kde
 %defattr(-,root,root)